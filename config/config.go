@@ -0,0 +1,390 @@
+// Package config loads declarative speedtest plans from YAML or JSON files.
+//
+// A plan looks like this in YAML:
+//
+//	target:
+//	  url: https://speed.example.com
+//	  download_path: /__down
+//	  upload_path: /__up
+//	  latency_path: /__down
+//	  family: both                              # ipv4 (default), ipv6 or both
+//	latencyreps: 20
+//	timeout: 5m
+//	iteration_timeout: 30s
+//	progress_interval: 100ms                    # throughput over time, 0 disables it
+//	adaptive:                                   # size the tests like speed.cloudflare.com, off by default
+//	  min_duration: 10ms                        # sizes with shorter transfers are skipped
+//	  target_duration: 1s                       # no larger size once a transfer lasts this long
+//	  max_duration: 30s                         # download and upload tests in total
+//	loaded_latency:                             # latency under load, off by default
+//	  duration: 10s
+//	  streams: 4
+//	  bytes: 25000000
+//	  probe_interval: 200ms
+//	download:
+//	  - {name: 100kB, bytes: 101000, iterations: 10}
+//	  - {name: 10MB, bytes: 10001000, iterations: 6}
+//	  - {name: 4x10MB, bytes: 10001000, iterations: 4, streams: 4}
+//	upload:
+//	  - {name: 1MB, bytes: 1001000, iterations: 6}
+//	labels:
+//	  site: ams1
+//	outputs:
+//	  - {type: prometheus}                      # written to stdout
+//	  - {type: json, path: /var/lib/cf/last.json}
+//	  - {type: textfile, path: /var/lib/node_exporter/cf.prom}
+//	  - {type: influxdb, url: http://influx:8086, org: net, bucket: speed, token_env: INFLUX_TOKEN}
+//
+// Every field except download or upload is optional. With adaptive, both
+// are optional too and default to the sizes of speed.cloudflare.com.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"cfspeedtest/speedtest"
+)
+
+// Config is a speedtest plan together with where its results go.
+type Config struct {
+	Target           Target            `yaml:"target" json:"target"`
+	LatencyReps      *int              `yaml:"latencyreps" json:"latencyreps"`
+	Timeout          Duration          `yaml:"timeout" json:"timeout"`
+	IterationTimeout *Duration         `yaml:"iteration_timeout" json:"iteration_timeout"`
+	ProgressInterval *Duration         `yaml:"progress_interval" json:"progress_interval"`
+	LoadedLatency    *LoadedLatency    `yaml:"loaded_latency" json:"loaded_latency"`
+	Adaptive         *Adaptive         `yaml:"adaptive" json:"adaptive"`
+	Download         []Test            `yaml:"download" json:"download"`
+	Upload           []Test            `yaml:"upload" json:"upload"`
+	Labels           map[string]string `yaml:"labels" json:"labels"`
+	Outputs          []Output          `yaml:"outputs" json:"outputs"`
+}
+
+// Target selects the speedtest server and its endpoints.
+type Target struct {
+	URL          string `yaml:"url" json:"url"`
+	DownloadPath string `yaml:"download_path" json:"download_path"`
+	UploadPath   string `yaml:"upload_path" json:"upload_path"`
+	LatencyPath  string `yaml:"latency_path" json:"latency_path"`
+	Family       string `yaml:"family" json:"family"`
+}
+
+// LoadedLatency enables the latency under load measurement. Fields that are
+// not set keep their defaults.
+type LoadedLatency struct {
+	Duration      Duration `yaml:"duration" json:"duration"`
+	Streams       int      `yaml:"streams" json:"streams"`
+	Bytes         int      `yaml:"bytes" json:"bytes"`
+	ProbeInterval Duration `yaml:"probe_interval" json:"probe_interval"`
+}
+
+// Adaptive enables adaptive test sizes. Fields that are not set keep their
+// defaults.
+type Adaptive struct {
+	MinDuration    Duration `yaml:"min_duration" json:"min_duration"`
+	TargetDuration Duration `yaml:"target_duration" json:"target_duration"`
+	MaxDuration    Duration `yaml:"max_duration" json:"max_duration"`
+}
+
+// Test is one entry of the download or upload plan.
+type Test struct {
+	Name       string `yaml:"name" json:"name"`
+	Bytes      int    `yaml:"bytes" json:"bytes"`
+	Iterations int    `yaml:"iterations" json:"iterations"`
+	// Streams is the number of concurrent transfers per iteration.
+	Streams int `yaml:"streams" json:"streams"`
+}
+
+// Output is a destination for the results. Type is one of the formats
+// text, json, prometheus, influx or csv, written to Path or stdout if Path
+// is empty or "-", or one of the sinks textfile and influxdb.
+type Output struct {
+	Type string `yaml:"type" json:"type"`
+	Path string `yaml:"path" json:"path"`
+
+	// influxdb sink
+	URL      string `yaml:"url" json:"url"`
+	Org      string `yaml:"org" json:"org"`
+	Bucket   string `yaml:"bucket" json:"bucket"`
+	TokenEnv string `yaml:"token_env" json:"token_env"`
+	Buffer   string `yaml:"buffer" json:"buffer"`
+}
+
+// Formats are the output types that serialize results to a file or stdout.
+var Formats = []string{"text", "json", "prometheus", "influx", "csv"}
+
+// Sinks are the output types with their own delivery.
+var Sinks = []string{"textfile", "influxdb"}
+
+// Duration is a time.Duration written as a string such as "30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\"")
+	}
+	return d.set(s)
+}
+
+func (d *Duration) UnmarshalYAML(n *yaml.Node) error {
+	if err := d.set(n.Value); err != nil {
+		return fmt.Errorf("line %d: %v", n.Line, err)
+	}
+	return nil
+}
+
+func (d *Duration) set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %v", s, err)
+	}
+	if v < 0 {
+		return fmt.Errorf("invalid duration %q: must not be negative", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Load reads and validates the config file at path. Files ending in .json
+// are parsed as JSON, everything else as YAML.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parse(data, strings.EqualFold(filepath.Ext(path), ".json"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+func parse(data []byte, isJSON bool) (*Config, error) {
+	c := &Config{}
+	if isJSON {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			switch {
+			case errors.As(err, &syntaxErr):
+				return nil, fmt.Errorf("line %d: %v", lineOf(data, syntaxErr.Offset), err)
+			case errors.As(err, &typeErr):
+				return nil, fmt.Errorf("line %d: %s must be %s", lineOf(data, typeErr.Offset), typeErr.Field, typeErr.Type)
+			}
+			return nil, err
+		}
+		return c, nil
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return c, nil
+}
+
+// lineOf converts a byte offset into a 1-based line number.
+func lineOf(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// Validate reports the first problem with the config.
+func (c *Config) Validate() error {
+	if len(c.Download) == 0 && len(c.Upload) == 0 && c.Adaptive == nil {
+		return fmt.Errorf("at least one download or upload test is required")
+	}
+	if c.LatencyReps != nil && *c.LatencyReps < 0 {
+		return fmt.Errorf("latencyreps: must not be negative, got %d", *c.LatencyReps)
+	}
+	if l := c.LoadedLatency; l != nil {
+		switch {
+		case l.Duration == 0:
+			return fmt.Errorf("loaded_latency.duration: must be positive")
+		case l.Streams < 0:
+			return fmt.Errorf("loaded_latency.streams: must not be negative, got %d", l.Streams)
+		case l.Bytes < 0:
+			return fmt.Errorf("loaded_latency.bytes: must not be negative, got %d", l.Bytes)
+		}
+	}
+	if a := c.Adaptive; a != nil && a.TargetDuration != 0 && a.TargetDuration <= a.MinDuration {
+		return fmt.Errorf("adaptive.target_duration: must be longer than min_duration")
+	}
+	if err := validateTests("download", c.Download); err != nil {
+		return err
+	}
+	if err := validateTests("upload", c.Upload); err != nil {
+		return err
+	}
+	for name := range c.Labels {
+		if err := speedtest.ValidateLabel(name); err != nil {
+			return fmt.Errorf("labels: %v", err)
+		}
+	}
+	for i, o := range c.Outputs {
+		if err := o.Validate(); err != nil {
+			return fmt.Errorf("outputs[%d]: %v", i, err)
+		}
+	}
+	if err := c.Apply(speedtest.NewSpeedtest(nil, nil)).Validate(); err != nil {
+		return fmt.Errorf("target: %v", err)
+	}
+	return nil
+}
+
+func validateTests(field string, tests []Test) error {
+	names := map[string]int{}
+	for i, t := range tests {
+		switch {
+		case t.Name == "":
+			return fmt.Errorf("%s[%d].name: must not be empty", field, i)
+		case t.Bytes <= 0:
+			return fmt.Errorf("%s[%d].bytes: must be positive, got %d", field, i, t.Bytes)
+		case t.Iterations <= 0:
+			return fmt.Errorf("%s[%d].iterations: must be positive, got %d", field, i, t.Iterations)
+		case t.Streams < 0:
+			return fmt.Errorf("%s[%d].streams: must not be negative, got %d", field, i, t.Streams)
+		}
+		if j, ok := names[t.Name]; ok {
+			return fmt.Errorf("%s[%d].name: %q is already used by %s[%d]", field, i, t.Name, field, j)
+		}
+		names[t.Name] = i
+	}
+	return nil
+}
+
+// Validate reports the first problem with the output. The influxdb sink
+// needs its token in the environment variable named by TokenEnv.
+func (o Output) Validate() error {
+	switch {
+	case contains(Formats, o.Type):
+		return nil
+	case o.Type == "textfile":
+		if o.Path == "" || o.Path == "-" {
+			return fmt.Errorf("path: a file is required for the textfile output")
+		}
+		return nil
+	case o.Type == "influxdb":
+		if o.URL == "" {
+			return fmt.Errorf("url: required for the influxdb output")
+		}
+		if o.Org == "" {
+			return fmt.Errorf("org: required for the influxdb output")
+		}
+		if o.Bucket == "" {
+			return fmt.Errorf("bucket: required for the influxdb output")
+		}
+		if o.TokenEnv == "" {
+			return fmt.Errorf("token_env: required for the influxdb output, the environment variable holding the token")
+		}
+		if os.Getenv(o.TokenEnv) == "" {
+			return fmt.Errorf("token_env: environment variable %s is not set", o.TokenEnv)
+		}
+		return nil
+	case o.Type == "":
+		return fmt.Errorf("type: required, one of %s", strings.Join(append(Formats, Sinks...), ", "))
+	default:
+		return fmt.Errorf("type: unknown output %q, must be one of %s", o.Type, strings.Join(append(Formats, Sinks...), ", "))
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply copies the plan into s and returns it. Fields missing from the
+// config keep the values already set in s.
+func (c *Config) Apply(s *speedtest.Speedtest) *speedtest.Speedtest {
+	if c.Target.URL != "" {
+		s.BaseURL = c.Target.URL
+	}
+	if c.Target.DownloadPath != "" {
+		s.DownloadPath = c.Target.DownloadPath
+	}
+	if c.Target.UploadPath != "" {
+		s.UploadPath = c.Target.UploadPath
+	}
+	if c.Target.LatencyPath != "" {
+		s.LatencyPath = c.Target.LatencyPath
+	}
+	if c.Target.Family != "" {
+		s.Family = c.Target.Family
+	}
+	if c.LatencyReps != nil {
+		s.LatencyReps = *c.LatencyReps
+	}
+	if c.Timeout != 0 {
+		s.RunTimeout = time.Duration(c.Timeout)
+	}
+	if c.IterationTimeout != nil {
+		s.IterationTimeout = time.Duration(*c.IterationTimeout)
+	}
+	if c.ProgressInterval != nil {
+		s.ProgressInterval = time.Duration(*c.ProgressInterval)
+	}
+	if l := c.LoadedLatency; l != nil {
+		s.LoadDuration = time.Duration(l.Duration)
+		if l.Streams != 0 {
+			s.LoadStreams = l.Streams
+		}
+		if l.Bytes != 0 {
+			s.LoadBytes = l.Bytes
+		}
+		if l.ProbeInterval != 0 {
+			s.LoadProbeInterval = time.Duration(l.ProbeInterval)
+		}
+	}
+	s.DownloadTests = tests(c.Download)
+	s.UploadTests = tests(c.Upload)
+	if a := c.Adaptive; a != nil {
+		s.Adaptive = speedtest.NewAdaptive()
+		if a.MinDuration != 0 {
+			s.Adaptive.MinDuration = time.Duration(a.MinDuration)
+		}
+		if a.TargetDuration != 0 {
+			s.Adaptive.TargetDuration = time.Duration(a.TargetDuration)
+		}
+		if a.MaxDuration != 0 {
+			s.Adaptive.MaxDuration = time.Duration(a.MaxDuration)
+		}
+		if len(c.Download) == 0 && len(c.Upload) == 0 {
+			s.DownloadTests = append([]speedtest.Test{}, speedtest.AdaptiveDownloadTests...)
+			s.UploadTests = append([]speedtest.Test{}, speedtest.AdaptiveUploadTests...)
+		}
+	}
+	return s
+}
+
+func tests(plan []Test) []speedtest.Test {
+	out := make([]speedtest.Test, 0, len(plan))
+	for _, t := range plan {
+		test := speedtest.NewTest(t.Bytes, t.Iterations, t.Name)
+		test.Streams = t.Streams
+		out = append(out, *test)
+	}
+	return out
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cfspeedtest/speedtest"
+)
+
+// writeConfig writes data to a file named name in a temporary directory.
+func writeConfig(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyIterationTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want time.Duration
+	}{
+		{"", speedtest.DefaultIterationTimeout},
+		{"iteration_timeout: 5s\n", 5 * time.Second},
+		{"iteration_timeout: 0s\n", 0},
+	} {
+		c, err := Load(writeConfig(t, "plan.yaml", tc.line+"download:\n  - {name: 1MB, bytes: 1000000, iterations: 1}\n"))
+		if err != nil {
+			t.Fatalf("%q: %v", tc.line, err)
+		}
+		if got := c.Apply(speedtest.NewSpeedtest(nil, nil)).IterationTimeout; got != tc.want {
+			t.Errorf("%q: IterationTimeout = %v, want %v", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Setenv("CF_TEST_TOKEN", "secret")
+	t.Setenv("CF_TEST_UNSET", "")
+	const download = "download:\n  - {name: 1MB, bytes: 1000000, iterations: 1}\n"
+	for _, tc := range []struct {
+		name, file, data string
+		err              string
+	}{
+		// unknown keys
+		{"unknown key", "plan.yaml", "latency_reps: 5\n" + download, "field latency_reps not found"},
+		{"unknown nested key", "plan.yaml", "target: {uri: https://example.com}\n" + download, "field uri not found"},
+		{"unknown output key", "plan.yaml", download + "outputs:\n  - {type: json, file: out.json}\n", "field file not found"},
+		{"unknown json key", "plan.json", `{"latency_reps": 5, "download": [{"name": "1MB", "bytes": 1000000, "iterations": 1}]}`, `unknown field "latency_reps"`},
+
+		// durations
+		{"bad duration", "plan.yaml", "timeout: 5 minutes\n" + download, `line 1: invalid duration "5 minutes"`},
+		{"negative duration", "plan.yaml", download + "iteration_timeout: -1s\n", `line 3: invalid duration "-1s": must not be negative`},
+		{"bad nested duration", "plan.yaml", "loaded_latency: {duration: 10}\n" + download, `invalid duration "10"`},
+		{"json duration number", "plan.json", `{"timeout": 30, "download": [{"name": "1MB", "bytes": 1000000, "iterations": 1}]}`, `duration must be a string such as "30s"`},
+		{"json bad duration", "plan.json", `{"timeout": "30 s", "download": [{"name": "1MB", "bytes": 1000000, "iterations": 1}]}`, `invalid duration "30 s"`},
+
+		// outputs
+		{"unknown output", "plan.yaml", download + "outputs:\n  - {type: xml}\n", `outputs[0]: type: unknown output "xml", must be one of text, json, prometheus, influx, csv, textfile, influxdb`},
+		{"missing output type", "plan.yaml", download + "outputs:\n  - {type: json}\n  - {path: out.txt}\n", "outputs[1]: type: required, one of text, json"},
+		{"textfile without path", "plan.yaml", download + "outputs:\n  - {type: textfile}\n", "outputs[0]: path: a file is required for the textfile output"},
+		{"influxdb without url", "plan.yaml", download + "outputs:\n  - {type: influxdb, org: net, bucket: speed, token_env: CF_TEST_TOKEN}\n", "outputs[0]: url: required for the influxdb output"},
+		{"influxdb without org", "plan.yaml", download + "outputs:\n  - {type: influxdb, url: http://influx:8086, bucket: speed, token_env: CF_TEST_TOKEN}\n", "outputs[0]: org: required for the influxdb output"},
+		{"influxdb without bucket", "plan.yaml", download + "outputs:\n  - {type: influxdb, url: http://influx:8086, org: net, token_env: CF_TEST_TOKEN}\n", "outputs[0]: bucket: required for the influxdb output"},
+		{"influxdb without token_env", "plan.yaml", download + "outputs:\n  - {type: influxdb, url: http://influx:8086, org: net, bucket: speed}\n", "outputs[0]: token_env: required for the influxdb output"},
+		{"influxdb token not set", "plan.yaml", download + "outputs:\n  - {type: influxdb, url: http://influx:8086, org: net, bucket: speed, token_env: CF_TEST_UNSET}\n", "outputs[0]: token_env: environment variable CF_TEST_UNSET is not set"},
+
+		// plan
+		{"no tests", "plan.yaml", "latencyreps: 5\n", "at least one download or upload test is required"},
+		{"negative latencyreps", "plan.yaml", "latencyreps: -1\n" + download, "latencyreps: must not be negative, got -1"},
+		{"test without name", "plan.yaml", "upload:\n  - {bytes: 1000, iterations: 1}\n", "upload[0].name: must not be empty"},
+		{"test without bytes", "plan.yaml", "download:\n  - {name: 1MB, iterations: 1}\n", "download[0].bytes: must be positive, got 0"},
+		{"test without iterations", "plan.yaml", "download:\n  - {name: 1MB, bytes: 1000}\n", "download[0].iterations: must be positive, got 0"},
+		{"duplicate test", "plan.yaml", "download:\n  - {name: 1MB, bytes: 1000, iterations: 1}\n  - {name: 1MB, bytes: 2000, iterations: 1}\n", `download[1].name: "1MB" is already used by download[0]`},
+		{"loaded latency without duration", "plan.yaml", "loaded_latency: {streams: 2}\n" + download, "loaded_latency.duration: must be positive"},
+		{"adaptive target", "plan.yaml", "adaptive: {min_duration: 2s, target_duration: 1s}\n", "adaptive.target_duration: must be longer than min_duration"},
+	} {
+		path := writeConfig(t, tc.file, tc.data)
+		_, err := Load(path)
+		if err == nil {
+			t.Errorf("%s: Load succeeded, want %q", tc.name, tc.err)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), path+": ") || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: Load error %q, want %q prefixed with the path", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestLoadValid(t *testing.T) {
+	t.Setenv("CF_TEST_TOKEN", "secret")
+	for _, tc := range []struct {
+		file, data string
+		outputs    int
+	}{
+		{"plan.yaml", "timeout: 5m\ndownload:\n  - {name: 1MB, bytes: 1000000, iterations: 1}\noutputs:\n  - {type: json, path: out.json}\n  - {type: influxdb, url: http://influx:8086, org: net, bucket: speed, token_env: CF_TEST_TOKEN}\n", 2},
+		{"plan.json", `{"timeout": "5m", "download": [{"name": "1MB", "bytes": 1000000, "iterations": 1}], "outputs": [{"type": "json", "path": "out.json"}]}`, 1},
+		{"plan.yaml", "timeout: 5m\nadaptive: {}\n", 0},
+	} {
+		c, err := Load(writeConfig(t, tc.file, tc.data))
+		if err != nil {
+			t.Errorf("%s: %v", tc.data, err)
+			continue
+		}
+		if time.Duration(c.Timeout) != 5*time.Minute || len(c.Outputs) != tc.outputs {
+			t.Errorf("%s: timeout %v, %d outputs, want 5m, %d", tc.data, time.Duration(c.Timeout), len(c.Outputs), tc.outputs)
+		}
+	}
+}
@@ -2,3 +2,4 @@ module cfspeedtest
 
 go 1.22.11
 
+require gopkg.in/yaml.v3 v3.0.1
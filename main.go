@@ -1,22 +1,507 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"cfspeedtest/config"
 	"cfspeedtest/speedtest"
 )
 
+// version is updated during the release process with -ldflags=-X=main.version=...
+var version = "devel"
+
+const usage = `usage: cfspeedtest [command] [flags]
+
+commands:
+  run       measure latency, download and upload speed (default)
+  serve     run the built-in speedtest server
+  exporter  run the speedtest on an interval and serve /metrics
+  inspect   time a single request to a url
+  rpm       measure responsiveness under working conditions in round-trips per minute
+  version   print the version
+
+Run cfspeedtest <command> -h for the flags of a command.
+`
+
 func main() {
-	upload_tests := []speedtest.Test{
-		{NumBytes: 101000, Iterations: 8, Name: "100kB"},
-		{NumBytes: 1001000, Iterations: 6, Name: "1MB"},
-		{NumBytes: 10001000, Iterations: 4, Name: "10MB"},
+	cmd, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "run":
+		run(args)
+	case "serve":
+		serve(args)
+	case "exporter":
+		exporter(args)
+	case "inspect":
+		inspect(args)
+	case "rpm":
+		rpm(args)
+	case "version":
+		fmt.Println(version)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+}
+
+// run measures latency, download and upload speed once and writes the results.
+func run(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	newTest := speedtestFlags(fs)
+	format := fs.String("format", "text", "output `format`: text, json, prometheus, influx or csv")
+	fs.Var(labels, "label", "static `name=value` label added to prometheus metrics and influx points; repeatable")
+	textfile := fs.String("textfile", "", "also write prometheus metrics atomically to this node_exporter textfile collector `file`")
+	influxURL := fs.String("influx-url", "", "also send results to the InfluxDB 2 server at this base `url`, with the token in $INFLUX_TOKEN")
+	influxOrg := fs.String("influx-org", "", "InfluxDB `organization`")
+	influxBucket := fs.String("influx-bucket", "", "InfluxDB `bucket`")
+	influxBuffer := fs.String("influx-buffer", "", "`file` that keeps results InfluxDB could not accept until the next run")
+	showVersion := fs.Bool("v", false, "print the version and exit")
+	fs.Parse(args)
+
+	if *showVersion {
+		fmt.Println(version)
+		return
+	}
+
+	test, cfg := newTest()
+	outputs := cfg.Outputs
+	if len(outputs) == 0 || isSet(fs, "format") {
+		outputs = append(outputs, config.Output{Type: *format})
+	}
+	if *textfile != "" {
+		outputs = append(outputs, config.Output{Type: "textfile", Path: *textfile})
+	}
+	if *influxURL != "" {
+		// the token is read from the environment to keep it out of the process list
+		outputs = append(outputs, config.Output{Type: "influxdb", URL: *influxURL, Org: *influxOrg, Bucket: *influxBucket, Buffer: *influxBuffer, TokenEnv: "INFLUX_TOKEN"})
+	}
+	for _, o := range outputs {
+		if err := o.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid %s output: %v\n", o.Type, err)
+			os.Exit(2)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	results, err := test.RunFamilies(ctx)
+	for _, r := range results {
+		r.PrintFailures(os.Stderr)
+	}
+	outputFailed := false
+	for _, o := range outputs {
+		if werr := emit(o, results, err); werr != nil {
+			fmt.Fprintf(os.Stderr, "failed to write %s output: %v\n", o.Type, werr)
+			outputFailed = true
+		}
+	}
+	if err != nil {
+		stop()
+		fmt.Fprintln(os.Stderr, "speedtest failed:", err)
+		os.Exit(1)
+	}
+	if outputFailed {
+		stop()
+		os.Exit(1)
+	}
+}
+
+// emit delivers the results of a run, one per address family, to a single output.
+func emit(o config.Output, results []*speedtest.Result, runErr error) error {
+	switch o.Type {
+	case "textfile":
+		return speedtest.WriteTextfile(o.Path, labels, runErr, results...)
+	case "influxdb":
+		if len(results) == 0 {
+			return nil
+		}
+		sink := speedtest.NewInfluxSink(o.URL, o.Org, o.Bucket, os.Getenv(o.TokenEnv))
+		sink.BufferFile = o.Buffer
+		var batch bytes.Buffer
+		if err := speedtest.WriteInflux(&batch, labels, results...); err != nil {
+			return err
+		}
+		return sink.Write(context.Background(), batch.Bytes())
 	}
 
-	download_tests := []speedtest.Test{
-		{NumBytes: 101000, Iterations: 10, Name: "100kB"},
-		{NumBytes: 1001000, Iterations: 8, Name: "1MB"},
-		{NumBytes: 10001000, Iterations: 6, Name: "10MB"},
+	if len(results) == 0 {
+		return nil
+	}
+	if o.Path == "" || o.Path == "-" {
+		return formats[o.Type](os.Stdout, results...)
 	}
+	f, err := os.Create(o.Path)
+	if err != nil {
+		return err
+	}
+	if err := formats[o.Type](f, results...); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// speedtestFlags registers the flags that configure a speedtest on fs.
+// The returned function builds the speedtest once fs has been parsed. Flags
+// given on the command line take precedence over the -config file.
+func speedtestFlags(fs *flag.FlagSet) func() (*speedtest.Speedtest, *config.Config) {
+	configFile := fs.String("config", "", "YAML or JSON test plan `file`")
+	baseURL := fs.String("url", speedtest.DefaultBaseURL, "base `url` of the speedtest server")
+	downloadPath := fs.String("download-path", speedtest.DefaultDownloadPath, "download endpoint `path`, relative to -url")
+	uploadPath := fs.String("upload-path", speedtest.DefaultUploadPath, "upload endpoint `path`, relative to -url")
+	latencyPath := fs.String("latency-path", speedtest.DefaultLatencyPath, "latency endpoint `path`, relative to -url")
+	latencyReps := fs.Int("latencyreps", 20, "`number` of idle latency probes")
+	runTimeout := fs.Duration("timeout", 0, "abort the whole run after this `duration`; 0 disables the limit")
+	iterationTimeout := fs.Duration("iteration-timeout", speedtest.DefaultIterationTimeout, "abort a single transfer after this `duration`; 0 disables the limit")
+	progressInterval := fs.Duration("progress-interval", 100*time.Millisecond, "record the bytes moved by every transfer at this `interval`; 0 disables it")
+	streams := fs.Int("streams", 1, "`number` of concurrent transfers per download and upload iteration")
+	loadDuration := fs.Duration("loaded-latency", 0, "measure latency while saturating the download and then the upload for this `duration` each; 0 disables it")
+	adaptive := fs.Bool("adaptive", false, "size the tests like speed.cloudflare.com: skip sizes that transfer too fast and stop at sizes that take a second")
+	adaptiveMax := fs.Duration("adaptive-max-duration", 30*time.Second, "with -adaptive, stop the download and upload tests after this `duration` in total; 0 disables the limit")
+	loadStreams := fs.Int("load-streams", 4, "`number` of concurrent transfers that saturate the link for -loaded-latency")
+	applyTransport := transportFlags(fs)
+
+	return func() (*speedtest.Speedtest, *config.Config) {
+		upload_tests := []speedtest.Test{
+			{NumBytes: 101000, Iterations: 8, Name: "100kB"},
+			{NumBytes: 1001000, Iterations: 6, Name: "1MB"},
+			{NumBytes: 10001000, Iterations: 4, Name: "10MB"},
+		}
+
+		download_tests := []speedtest.Test{
+			{NumBytes: 101000, Iterations: 10, Name: "100kB"},
+			{NumBytes: 1001000, Iterations: 8, Name: "1MB"},
+			{NumBytes: 10001000, Iterations: 6, Name: "10MB"},
+		}
+
+		if *adaptive {
+			upload_tests = append([]speedtest.Test{}, speedtest.AdaptiveUploadTests...)
+			download_tests = append([]speedtest.Test{}, speedtest.AdaptiveDownloadTests...)
+		}
+
+		test := speedtest.NewSpeedtest(upload_tests, download_tests)
+		cfg := &config.Config{}
+		if *configFile != "" {
+			var err error
+			if cfg, err = config.Load(*configFile); err != nil {
+				fmt.Fprintln(os.Stderr, "invalid config:", err)
+				os.Exit(2)
+			}
+			cfg.Apply(test)
+			for name, value := range cfg.Labels {
+				if _, ok := labels[name]; !ok {
+					labels[name] = value
+				}
+			}
+		}
 
-	test := speedtest.NewSpeedtest(upload_tests, download_tests)
-	test.RunAllTests()
+		set := func(name string, apply func()) {
+			if *configFile == "" || isSet(fs, name) {
+				apply()
+			}
+		}
+		set("url", func() { test.BaseURL = *baseURL })
+		set("download-path", func() { test.DownloadPath = *downloadPath })
+		set("upload-path", func() { test.UploadPath = *uploadPath })
+		set("latency-path", func() { test.LatencyPath = *latencyPath })
+		set("latencyreps", func() { test.LatencyReps = *latencyReps })
+		set("timeout", func() { test.RunTimeout = *runTimeout })
+		set("iteration-timeout", func() { test.IterationTimeout = *iterationTimeout })
+		set("progress-interval", func() { test.ProgressInterval = *progressInterval })
+		set("loaded-latency", func() { test.LoadDuration = *loadDuration })
+		set("load-streams", func() { test.LoadStreams = *loadStreams })
+		if *adaptive && test.Adaptive == nil {
+			test.Adaptive = speedtest.NewAdaptive()
+		}
+		if test.Adaptive != nil && isSet(fs, "adaptive-max-duration") {
+			test.Adaptive.MaxDuration = *adaptiveMax
+		}
+		set("streams", func() {
+			for i := range test.DownloadTests {
+				test.DownloadTests[i].Streams = *streams
+			}
+			for i := range test.UploadTests {
+				test.UploadTests[i].Streams = *streams
+			}
+		})
+		applyTransport(test)
+		if err := test.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid target:", err)
+			os.Exit(2)
+		}
+		return test, cfg
+	}
+}
+
+// transportFlags registers the flags that control how requests are made.
+// The returned function applies them to a speedtest once fs has been parsed.
+func transportFlags(fs *flag.FlagSet) func(*speedtest.Speedtest) {
+	var hdrs speedtest.Headers
+	fs.Var(&hdrs, "H", "set a request `header` such as \"Accept: */*\"; repeatable")
+	insecure := fs.Bool("k", false, "allow insecure TLS connections")
+	clientCertFile := fs.String("E", "", "client certificate `file` for TLS, containing the certificate and its private key in PEM format")
+	fourOnly := fs.Bool("4", false, "connect over IPv4 only, same as -family ipv4")
+	sixOnly := fs.Bool("6", false, "connect over IPv6 only, same as -family ipv6")
+	family := fs.String("family", "", "address `family`: ipv4 (default), ipv6 or both; both runs every test once per family")
+
+	return func(test *speedtest.Speedtest) {
+		if *fourOnly && *sixOnly {
+			fmt.Fprintln(os.Stderr, "-4 and -6 are mutually exclusive")
+			os.Exit(2)
+		}
+		if (*fourOnly || *sixOnly) && *family != "" {
+			fmt.Fprintln(os.Stderr, "-family cannot be combined with -4 or -6")
+			os.Exit(2)
+		}
+		switch {
+		case *fourOnly:
+			test.Family = speedtest.FamilyIPv4
+		case *sixOnly:
+			test.Family = speedtest.FamilyIPv6
+		case *family != "":
+			test.Family = *family
+		}
+		test.Headers = append(test.Headers, hdrs...)
+		test.Insecure = *insecure
+		test.ClientCertFile = *clientCertFile
+	}
+}
+
+// isSet reports whether the flag name was given on the command line.
+func isSet(fs *flag.FlagSet, name string) bool {
+	found := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
+// formats maps the -format values to their writers.
+var formats = map[string]func(io.Writer, ...*speedtest.Result) error{
+	"text": func(w io.Writer, results ...*speedtest.Result) error {
+		for i, r := range results {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			if err := r.Print(w); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	"json": func(w io.Writer, results ...*speedtest.Result) error { return speedtest.WriteJSON(w, results...) },
+	"prometheus": func(w io.Writer, results ...*speedtest.Result) error {
+		return speedtest.WritePrometheus(w, labels, results...)
+	},
+	"influx": func(w io.Writer, results ...*speedtest.Result) error {
+		return speedtest.WriteInflux(w, labels, results...)
+	},
+	"csv": func(w io.Writer, results ...*speedtest.Result) error { return speedtest.WriteCSV(w, results...) },
+}
+
+// labels are the static labels given with -label.
+var labels = labelFlag{}
+
+// labelFlag collects name=value pairs.
+type labelFlag map[string]string
+
+func (l labelFlag) String() string {
+	var o []string
+	for k, v := range l {
+		o = append(o, k+"="+v)
+	}
+	sort.Strings(o)
+	return strings.Join(o, ",")
+}
+
+func (l labelFlag) Set(v string) error {
+	name, value, ok := strings.Cut(v, "=")
+	if !ok {
+		return fmt.Errorf("label %q has invalid format, missing '='", v)
+	}
+	if err := speedtest.ValidateLabel(name); err != nil {
+		return err
+	}
+	l[name] = value
+	return nil
+}
+
+// serve runs the built-in speedtest server until it fails.
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":8080", "`address` to listen on")
+	certFile := fs.String("tls-cert", "", "TLS certificate `file`; serves HTTPS together with -tls-key")
+	keyFile := fs.String("tls-key", "", "TLS private key `file`")
+	maxBytes := fs.Int64("max-bytes", 1<<30, "largest download size the server will stream")
+	colo := fs.String("colo", "local", "colo `name` reported by the trace endpoint")
+	fs.Parse(args)
+
+	handler := speedtest.NewServer()
+	handler.MaxBytes = *maxBytes
+	handler.Colo = *colo
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Printf("speedtest server listening on %s", *listen)
+	var err error
+	if *certFile != "" || *keyFile != "" {
+		err = srv.ListenAndServeTLS(*certFile, *keyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	log.Fatal(err)
+}
+
+// exporter runs the speedtest on an interval and serves the results on /metrics.
+func exporter(args []string) {
+	fs := flag.NewFlagSet("exporter", flag.ExitOnError)
+	newTest := speedtestFlags(fs)
+	listen := fs.String("listen", ":9090", "`address` to serve /metrics on")
+	interval := fs.Duration("interval", 15*time.Minute, "`duration` between the starts of two runs")
+	fs.Var(labels, "label", "static `name=value` label added to every metric; repeatable")
+	fs.Parse(args)
+
+	test, _ := newTest()
+	if *interval <= 0 {
+		fmt.Fprintln(os.Stderr, "-interval must be positive")
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	e := speedtest.NewExporter(test, *interval, labels)
+	go e.Run(ctx)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	log.Printf("speedtest exporter listening on %s", *listen)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// inspect times a single request to a url and prints the response headers.
+func inspect(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: cfspeedtest inspect [flags] url")
+		fs.PrintDefaults()
+	}
+	method := fs.String("X", "", "HTTP `method` to use (default GET, or POST with -d)")
+	body := fs.String("d", "", "request `body`; @file sends the contents of file")
+	followRedirects := fs.Bool("L", false, "follow redirects")
+	onlyHeader := fs.Bool("I", false, "send a HEAD request and only show the response headers")
+	saveOutput := fs.Bool("O", false, "save the body of the response under its remote name")
+	outputFile := fs.String("o", "", "save the body of the response to `file`")
+	applyTransport := transportFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	test := speedtest.NewSpeedtest(nil, nil)
+	applyTransport(test)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err := test.Inspect(ctx, os.Stdout, fs.Arg(0), speedtest.InspectOptions{
+		Method:          *method,
+		Body:            *body,
+		FollowRedirects: *followRedirects,
+		OnlyHeader:      *onlyHeader,
+		SaveOutput:      *saveOutput,
+		OutputFile:      *outputFile,
+	})
+	if err != nil {
+		stop()
+		fmt.Fprintln(os.Stderr, "inspect failed:", err)
+		os.Exit(1)
+	}
+}
+
+// rpm measures responsiveness under working conditions, like networkQuality.
+func rpm(args []string) {
+	fs := flag.NewFlagSet("rpm", flag.ExitOnError)
+	baseURL := fs.String("url", "", "base `url` of a server that serves the responsiveness config on "+speedtest.RPMConfigPath+", such as cfspeedtest serve; required unless -config-url is set")
+	configURL := fs.String("config-url", "", "`url` of the responsiveness config, overrides -url")
+	maxDuration := fs.Duration("max-duration", 20*time.Second, "longest `duration` of each direction")
+	maxConnections := fs.Int("max-connections", 16, "largest `number` of load-generating connections")
+	format := fs.String("format", "text", "output `format`: text or json")
+	applyTransport := transportFlags(fs)
+	fs.Parse(args)
+
+	if *baseURL == "" && *configURL == "" {
+		// speed.cloudflare.com has no responsiveness config
+		fmt.Fprintln(os.Stderr, "-url or -config-url is required: the server must serve a responsiveness config on "+speedtest.RPMConfigPath+", as cfspeedtest serve does")
+		os.Exit(2)
+	}
+
+	test := speedtest.NewSpeedtest(nil, nil)
+	if *baseURL != "" {
+		test.BaseURL = *baseURL
+	}
+	applyTransport(test)
+	if *configURL == "" {
+		*configURL = strings.TrimSuffix(*baseURL, "/") + speedtest.RPMConfigPath
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *format)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	result, err := test.Responsiveness(ctx, *configURL, speedtest.RPMOptions{
+		MaxDuration:    *maxDuration,
+		MaxConnections: *maxConnections,
+	})
+	if result != nil {
+		var werr error
+		if *format == "json" {
+			werr = speedtest.WriteRPMJSON(os.Stdout, result)
+		} else {
+			werr = result.Print(os.Stdout)
+		}
+		if werr != nil {
+			fmt.Fprintln(os.Stderr, "failed to write output:", werr)
+		}
+	}
+	if err != nil {
+		stop()
+		fmt.Fprintln(os.Stderr, "rpm failed:", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cfspeedtest/speedtest"
+)
+
+func TestSpeedtestFlagsOverrideConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plan.yaml")
+	plan := `target: {url: https://speed.example.com, download_path: /down}
+latencyreps: 5
+iteration_timeout: 10s
+progress_interval: 0s
+download:
+  - {name: 1MB, bytes: 1000000, iterations: 2}
+labels: {site: ams1, host: a}
+`
+	if err := os.WriteFile(path, []byte(plan), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		// want
+		url, downloadPath string
+		latencyReps       int
+		iterationTimeout  time.Duration
+		progressInterval  time.Duration
+		streams           int
+	}{
+		{"config only", nil, "https://speed.example.com", "/down", 5, 10 * time.Second, 0, 0},
+		{"flags set", []string{"-url", "https://other.example.com", "-latencyreps", "7", "-iteration-timeout", "0", "-progress-interval", "50ms", "-streams", "2"},
+			"https://other.example.com", "/down", 7, 0, 50 * time.Millisecond, 2},
+		// a flag set to its default still overrides the config
+		{"flag set to default", []string{"-latencyreps", "20", "-download-path", speedtest.DefaultDownloadPath},
+			"https://speed.example.com", speedtest.DefaultDownloadPath, 20, 10 * time.Second, 0, 0},
+	} {
+		labels = labelFlag{"host": "b"}
+		fs := flag.NewFlagSet("run", flag.ContinueOnError)
+		build := speedtestFlags(fs)
+		if err := fs.Parse(append([]string{"-config", path}, tc.args...)); err != nil {
+			t.Fatal(err)
+		}
+		test, _ := build()
+		if test.BaseURL != tc.url || test.DownloadPath != tc.downloadPath {
+			t.Errorf("%s: url %q, download path %q, want %q, %q", tc.name, test.BaseURL, test.DownloadPath, tc.url, tc.downloadPath)
+		}
+		if test.LatencyReps != tc.latencyReps || test.IterationTimeout != tc.iterationTimeout || test.ProgressInterval != tc.progressInterval {
+			t.Errorf("%s: latencyreps %d, iteration timeout %v, progress interval %v, want %d, %v, %v", tc.name,
+				test.LatencyReps, test.IterationTimeout, test.ProgressInterval, tc.latencyReps, tc.iterationTimeout, tc.progressInterval)
+		}
+		if len(test.DownloadTests) != 1 || test.DownloadTests[0].Streams != tc.streams || len(test.UploadTests) != 0 {
+			t.Errorf("%s: download tests %+v, upload tests %+v, want the config plan with %d streams", tc.name, test.DownloadTests, test.UploadTests, tc.streams)
+		}
+		// labels from -label win over the config
+		if labels["site"] != "ams1" || labels["host"] != "b" {
+			t.Errorf("%s: labels %v", tc.name, labels)
+		}
+	}
+	labels = labelFlag{}
+}
+
+func TestSpeedtestFlagsWithoutConfig(t *testing.T) {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	build := speedtestFlags(fs)
+	if err := fs.Parse([]string{"-latencyreps", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	test, cfg := build()
+	if test.BaseURL != speedtest.DefaultBaseURL || test.LatencyReps != 3 || test.IterationTimeout != speedtest.DefaultIterationTimeout {
+		t.Errorf("url %q, latencyreps %d, iteration timeout %v", test.BaseURL, test.LatencyReps, test.IterationTimeout)
+	}
+	if len(test.DownloadTests) != 3 || len(test.UploadTests) != 3 || len(cfg.Outputs) != 0 {
+		t.Errorf("%d download and %d upload tests, %d outputs", len(test.DownloadTests), len(test.UploadTests), len(cfg.Outputs))
+	}
+}
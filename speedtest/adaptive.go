@@ -0,0 +1,117 @@
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Adaptive sizes the download and upload tests like speed.cloudflare.com.
+// The tests of a direction run in order of size: a size is skipped as soon
+// as one of its transfers is shorter than MinDuration, and once a transfer
+// lasts TargetDuration or longer, the size is finished and no larger one is
+// tried. The download and upload tests stop after MaxDuration in total; the
+// transfer interrupted by it is not counted, and no upload test is run if
+// the downloads used it up.
+type Adaptive struct {
+	MinDuration, TargetDuration time.Duration
+	// MaxDuration caps the download and upload tests together, not the
+	// latency measurements; zero means no limit.
+	MaxDuration time.Duration
+}
+
+func NewAdaptive() *Adaptive {
+	return &Adaptive{
+		MinDuration:    10 * time.Millisecond,
+		TargetDuration: time.Second,
+		MaxDuration:    30 * time.Second,
+	}
+}
+
+// AdaptiveDownloadTests and AdaptiveUploadTests are the transfer sizes and
+// counts of speed.cloudflare.com, meant to be run with Adaptive.
+var (
+	AdaptiveDownloadTests = []Test{
+		{NumBytes: 100000, Iterations: 10, Name: "100kB"},
+		{NumBytes: 1000000, Iterations: 8, Name: "1MB"},
+		{NumBytes: 10000000, Iterations: 6, Name: "10MB"},
+		{NumBytes: 25000000, Iterations: 4, Name: "25MB"},
+		{NumBytes: 100000000, Iterations: 3, Name: "100MB"},
+	}
+	AdaptiveUploadTests = []Test{
+		{NumBytes: 100000, Iterations: 8, Name: "100kB"},
+		{NumBytes: 1000000, Iterations: 6, Name: "1MB"},
+		{NumBytes: 10000000, Iterations: 4, Name: "10MB"},
+		{NumBytes: 25000000, Iterations: 4, Name: "25MB"},
+		{NumBytes: 50000000, Iterations: 3, Name: "50MB"},
+	}
+)
+
+func (a *Adaptive) validate() error {
+	switch {
+	case a.MinDuration < 0 || a.MaxDuration < 0:
+		return fmt.Errorf("adaptive durations must not be negative")
+	case a.TargetDuration <= a.MinDuration:
+		return fmt.Errorf("adaptive target duration %v must be longer than the minimum duration %v", a.TargetDuration, a.MinDuration)
+	}
+	return nil
+}
+
+// adaptiveDeadline derives the context that ends the adaptive tests after
+// MaxDuration.
+func (s *Speedtest) adaptiveDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.Adaptive.MaxDuration > 0 {
+		return context.WithTimeout(ctx, s.Adaptive.MaxDuration)
+	}
+	return context.WithCancel(ctx)
+}
+
+// adaptive runs tests with run as described for Adaptive until capped, from
+// adaptiveDeadline, is done, and returns the results of the sizes it tried,
+// smallest first.
+func (s *Speedtest) adaptive(ctx, capped context.Context, tests []Test, run func(ctx context.Context, numbytes, iterations, streams int) ([]Sample, error)) ([]TestResult, error) {
+	ladder := append([]Test{}, tests...)
+	sort.SliceStable(ladder, func(i, j int) bool { return ladder[i].NumBytes < ladder[j].NumBytes })
+
+	var results []TestResult
+	for _, test := range ladder {
+		var samples []Sample
+		var skipped, long, timeUp bool
+		for i := 0; i < test.Iterations; i++ {
+			batch, err := run(capped, test.NumBytes, 1, test.Streams)
+			if ctx.Err() == nil && capped.Err() != nil {
+				// the interrupted transfer does not count
+				timeUp = true
+				break
+			}
+			for _, x := range batch {
+				x.Iteration = i
+				samples = append(samples, x)
+			}
+			if err != nil {
+				return append(results, newTestResult(test, samples)), fmt.Errorf("%s: %v", test.Name, err)
+			}
+			x := samples[len(samples)-1]
+			if !x.OK() {
+				continue
+			}
+			if x.Transfer < s.Adaptive.MinDuration {
+				skipped = true
+				break
+			}
+			if x.Transfer >= s.Adaptive.TargetDuration {
+				long = true
+			}
+		}
+		if len(samples) > 0 {
+			tr := newTestResult(test, samples)
+			tr.Skipped = skipped
+			results = append(results, tr)
+		}
+		if long || timeUp {
+			break
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,110 @@
+package speedtest
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+var adaptiveTestLadder = []Test{
+	// out of order on purpose, the ladder runs smallest first
+	{NumBytes: 1000, Iterations: 3, Name: "1kB"},
+	{NumBytes: 100, Iterations: 3, Name: "100B"},
+	{NumBytes: 10000, Iterations: 3, Name: "10kB"},
+	{NumBytes: 100000, Iterations: 3, Name: "100kB"},
+}
+
+// fakeTransfers returns a run function whose transfers of numbytes last
+// durations[numbytes], and counts the transfers of every size.
+func fakeTransfers(durations map[int]time.Duration, runs map[int]int) func(ctx context.Context, numbytes, iterations, streams int) ([]Sample, error) {
+	return func(ctx context.Context, numbytes, iterations, streams int) ([]Sample, error) {
+		runs[numbytes]++
+		return []Sample{{Status: 200, Bytes: int64(numbytes), Transfer: durations[numbytes]}}, nil
+	}
+}
+
+func newAdaptiveTest() *Speedtest {
+	s := NewSpeedtest(nil, nil)
+	s.Adaptive = &Adaptive{MinDuration: 10 * time.Millisecond, TargetDuration: time.Second}
+	return s
+}
+
+func TestAdaptiveLadder(t *testing.T) {
+	s := newAdaptiveTest()
+	runs := map[int]int{}
+	run := fakeTransfers(map[int]time.Duration{
+		100:    time.Millisecond,
+		1000:   500 * time.Millisecond,
+		10000:  2 * time.Second,
+		100000: 20 * time.Second,
+	}, runs)
+	ctx := context.Background()
+	results, err := s.adaptive(ctx, ctx, adaptiveTestLadder, run)
+	if err != nil {
+		t.Fatalf("adaptive: %v", err)
+	}
+
+	var names []string
+	for _, tr := range results {
+		names = append(names, tr.Test.Name)
+	}
+	if len(results) != 3 {
+		t.Fatalf("tried %v, want 100B, 1kB and 10kB", names)
+	}
+	// too short: skipped after the first transfer
+	if tr := results[0]; tr.Test.Name != "100B" || !tr.Skipped || len(tr.Samples) != 1 {
+		t.Errorf("%s: skipped %v after %d transfers, want skipped after 1", tr.Test.Name, tr.Skipped, len(tr.Samples))
+	}
+	// shorter than the target: all iterations, then the next size
+	if tr := results[1]; tr.Test.Name != "1kB" || tr.Skipped || tr.Succeeded != 3 {
+		t.Errorf("%s: skipped %v with %d transfers, want all 3", tr.Test.Name, tr.Skipped, tr.Succeeded)
+	}
+	// reaches the target: the size is finished and no larger one tried
+	if tr := results[2]; tr.Test.Name != "10kB" || tr.Succeeded != 3 {
+		t.Errorf("%s: %d transfers, want all 3", tr.Test.Name, tr.Succeeded)
+	}
+	if runs[100000] != 0 {
+		t.Errorf("ran %d transfers of the size after the target was reached", runs[100000])
+	}
+	for i, tr := range results {
+		for j, x := range tr.Samples {
+			if x.Iteration != j {
+				t.Errorf("results[%d].Samples[%d].Iteration = %d", i, j, x.Iteration)
+			}
+		}
+	}
+}
+
+func TestAdaptiveMaxDuration(t *testing.T) {
+	s := newAdaptiveTest()
+	s.Adaptive.MaxDuration = time.Hour
+	ctx := context.Background()
+	capped, cancel := s.adaptiveDeadline(ctx)
+	defer cancel()
+
+	// the cap passes during the second transfer of the second size
+	transfers := 0
+	run := func(ctx context.Context, numbytes, iterations, streams int) ([]Sample, error) {
+		transfers++
+		if transfers == 5 {
+			cancel()
+		}
+		return []Sample{{Status: 200, Bytes: int64(numbytes), Transfer: 100 * time.Millisecond}}, nil
+	}
+	download, err := s.adaptive(ctx, capped, adaptiveTestLadder, run)
+	if err != nil {
+		t.Fatalf("adaptive: %v", err)
+	}
+	if len(download) != 2 || download[0].Succeeded != 3 || download[1].Succeeded != 1 {
+		t.Fatalf("got %d sizes, want 3 transfers of 100B and the 1 of 1kB before the cap", len(download))
+	}
+
+	// the cap covers the upload as well
+	upload, err := s.adaptive(ctx, capped, adaptiveTestLadder, run)
+	if err != nil {
+		t.Fatalf("adaptive: %v", err)
+	}
+	if len(upload) != 0 {
+		t.Errorf("upload ran %d sizes after the cap", len(upload))
+	}
+}
@@ -0,0 +1,103 @@
+package speedtest
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+// csvHeader names the columns written by WriteCSV. Durations are in seconds.
+var csvHeader = []string{
+	"start_timestamp", "family", "direction", "test", "iteration", "bytes",
+	"dns_seconds", "tcp_seconds", "tls_seconds", "server_seconds", "transfer_seconds", "full_seconds",
+	"status", "phase", "timed_out", "error",
+	"streams", "fairness",
+	"connect_seconds", "protocol", "tls_version", "cipher_suite", "alpn", "reused", "was_idle", "idle_seconds",
+	"server_timing_seconds", "rtt_seconds", "raw_transfer_seconds",
+	"steady_bits_per_second", "planned_bytes",
+}
+
+// WriteCSV writes one row per iteration, including the latency probes,
+// whose direction is "latency", and the probes of the latency under load
+// measurement, whose direction is "loaded_latency" and test the direction
+// of the load. The durations of failed iterations are empty.
+// Families that were unreachable only have their failed latency rows.
+// Multi-stream iterations get one row with the combined timings; fairness
+// is only set for them. server_timing_seconds and rtt_seconds are empty if
+// the server did not send Server-Timing; transfer_seconds of uploads then
+// excludes the server time and raw_transfer_seconds is as measured.
+// steady_bits_per_second is empty for transfers too short to leave their
+// ramp-up; the progress series is only written by WriteJSON.
+// bytes counts the bytes actually moved, for multi-stream iterations while
+// all streams were transferring; planned_bytes is the size of the test.
+func WriteCSV(w io.Writer, results ...*Result) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	for _, r := range results {
+		start := strconv.FormatInt(r.Start.Unix(), 10)
+		for _, x := range r.LatencySamples {
+			cw.Write(csvRow(start, r.Family, "latency", "", 0, x))
+		}
+		for _, tr := range r.Download {
+			for _, x := range tr.Samples {
+				cw.Write(csvRow(start, r.Family, "download", tr.Test.Name, tr.Test.NumBytes, x))
+			}
+		}
+		for _, tr := range r.Upload {
+			for _, x := range tr.Samples {
+				cw.Write(csvRow(start, r.Family, "upload", tr.Test.Name, tr.Test.NumBytes, x))
+			}
+		}
+		for _, l := range r.LoadedLatency {
+			for _, x := range l.Samples {
+				cw.Write(csvRow(start, r.Family, "loaded_latency", l.Direction, 0, x))
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvRow(start, family, direction, test string, numbytes int, x Sample) []string {
+	seconds := func(d time.Duration) string {
+		if !x.OK() {
+			return ""
+		}
+		return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+	}
+	status, errMsg := "", ""
+	if x.Status != 0 {
+		status = strconv.Itoa(x.Status)
+	}
+	if x.Err != nil {
+		errMsg = x.Err.Error()
+	}
+	streams, fairness := "1", ""
+	if len(x.Streams) > 0 {
+		streams = strconv.Itoa(len(x.Streams))
+	}
+	if x.Fairness > 0 {
+		fairness = strconv.FormatFloat(x.Fairness, 'f', -1, 64)
+	}
+	serverTiming, rtt := "", ""
+	if x.ServerTiming > 0 {
+		serverTiming = seconds(x.ServerTiming)
+	}
+	if x.RTT > 0 {
+		rtt = seconds(x.RTT)
+	}
+	steady := ""
+	if x.SteadyBitsPerSecond > 0 {
+		steady = strconv.FormatFloat(x.SteadyBitsPerSecond, 'f', -1, 64)
+	}
+	return []string{
+		start, family, direction, test, strconv.Itoa(x.Iteration), strconv.FormatInt(x.Bytes, 10),
+		seconds(x.DNS), seconds(x.TCP), seconds(x.TLS), seconds(x.Server), seconds(x.Transfer), seconds(x.Full),
+		status, x.Phase, strconv.FormatBool(x.TimedOut), errMsg,
+		streams, fairness,
+		seconds(x.Connect), x.Proto, x.TLSVersion, x.CipherSuite, x.ALPN, strconv.FormatBool(x.Reused), strconv.FormatBool(x.WasIdle), seconds(x.IdleTime),
+		serverTiming, rtt, seconds(x.RawTransfer),
+		steady, strconv.Itoa(numbytes),
+	}
+}
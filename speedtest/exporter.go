@@ -0,0 +1,118 @@
+package speedtest
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Exporter runs the speedtest on an interval and serves the latest results
+// in the Prometheus text exposition format. Scrapes only read the cached
+// results, so overlapping scrapes never start additional runs.
+type Exporter struct {
+	Speedtest *Speedtest
+	Interval  time.Duration
+	// Labels are added to every exported sample.
+	Labels map[string]string
+
+	// running is held for the duration of a run
+	running sync.Mutex
+
+	mu           sync.Mutex
+	latest       []*Result
+	inProgress   bool
+	lastDuration time.Duration
+	lastSuccess  time.Time
+	runs         int
+	failures     int
+}
+
+func NewExporter(s *Speedtest, interval time.Duration, labels map[string]string) *Exporter {
+	return &Exporter{
+		Speedtest: s,
+		Interval:  interval,
+		Labels:    labels,
+	}
+}
+
+// Run runs the speedtest immediately and then every Interval until ctx is done.
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	for {
+		if err := e.RunOnce(ctx); err != nil {
+			log.Printf("speedtest run failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce runs the speedtest and caches its results. It returns without
+// doing anything if another run is still in progress.
+func (e *Exporter) RunOnce(ctx context.Context) error {
+	if !e.running.TryLock() {
+		return nil
+	}
+	defer e.running.Unlock()
+
+	e.mu.Lock()
+	e.inProgress = true
+	e.mu.Unlock()
+
+	start := time.Now()
+	results, err := e.Speedtest.RunFamilies(ctx)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.inProgress = false
+	e.lastDuration = time.Since(start)
+	e.runs++
+	if err != nil {
+		e.failures++
+		return err
+	}
+	e.latest = results
+	e.lastSuccess = time.Now()
+	return nil
+}
+
+// ServeHTTP writes the cached results and the exporter's own metrics.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p, err := newPromWriter(e.Labels)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	e.mu.Lock()
+	inProgress := 0.0
+	if e.inProgress {
+		inProgress = 1
+	}
+	p.add("cf_exporter_run_in_progress", "gauge", "Whether a speedtest run is in progress.", inProgress)
+	p.add("cf_exporter_runs_total", "counter", "Number of completed speedtest runs.", float64(e.runs))
+	p.add("cf_exporter_failures_total", "counter", "Number of speedtest runs that failed.", float64(e.failures))
+	p.add("cf_exporter_last_run_duration_seconds", "gauge", "Duration of the last speedtest run.", e.lastDuration.Seconds())
+	if !e.lastSuccess.IsZero() {
+		p.add("cf_exporter_last_success_timestamp_seconds", "gauge", "Unix time the last successful speedtest run ended.", float64(e.lastSuccess.UnixNano())/1e9)
+	}
+	for _, r := range e.latest {
+		p.addResult(r)
+	}
+	e.mu.Unlock()
+
+	var b bytes.Buffer
+	if err := p.write(&b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,391 @@
+package speedtest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// influxTags are the tags set by WriteInflux itself.
+var influxTags = map[string]bool{"target": true, "family": true, "direction": true, "test": true}
+
+// WriteInflux writes results in InfluxDB line protocol, timestamped with the
+// start of each run in nanoseconds. tags are added to every point and must
+// not collide with the built-in ones.
+//
+//	cf_latency,target=<host>,family=ipv4 reachable=true,latency_seconds=,jitter_seconds=,dns_seconds=,rtt_seconds=,<connections>
+//	cf_test,target=<host>,family=ipv4,direction=download,test=100kB bits_per_second=,steady_bits_per_second=,latency_seconds=,jitter_seconds=,rtt_seconds=,bytes=i,streams=i,succeeded=i,failed=i,timed_out=i,skipped=false,fairness=,<connections>
+//	cf_aggregate,target=<host>,family=ipv4,direction=download p90_bits_per_second=,per_test_p90_bits_per_second=
+//	cf_loaded_latency,target=<host>,family=ipv4,direction=download latency_seconds=,jitter_seconds=,p50_seconds=,p90_seconds=,p99_seconds=,increase_seconds=,load_bits_per_second=,grade="",succeeded=i,failed=i,load_succeeded=i,load_failed=i
+//
+// where <connections> are the fields protocol="",tls_version="",reused=i,
+// tls_handshake_p50_seconds=,tls_handshake_p90_seconds=,tls_handshake_p99_seconds=;
+// cf_latency has those of the whole run. rtt_seconds is left out unless the
+// server sent Server-Timing, steady_bits_per_second unless the transfers
+// were long enough to leave their ramp-up, skipped unless the tests were
+// sized adaptively. An unreachable family only gets a cf_latency
+// point with reachable=false.
+func WriteInflux(w io.Writer, tags map[string]string, results ...*Result) error {
+	for k := range tags {
+		if influxTags[k] {
+			return fmt.Errorf("tag %q is reserved", k)
+		}
+	}
+	var b bytes.Buffer
+	for _, r := range results {
+		target := r.Target
+		if u, err := parseURL(r.Target); err == nil {
+			target = u.Host
+		}
+		ts := r.Start.UnixNano()
+		base := append(sortedTags(tags), "target", target, "family", r.Family)
+
+		if r.Unreachable != "" {
+			writeInfluxPoint(&b, "cf_latency", base, ts, "reachable", false)
+			continue
+		}
+		fields := []interface{}{
+			"reachable", true,
+			"latency_seconds", r.Latency.Seconds(),
+			"jitter_seconds", r.Jitter.Seconds(),
+			"dns_seconds", r.DNSTime.Seconds(),
+		}
+		if r.RTT > 0 {
+			fields = append(fields, "rtt_seconds", r.RTT.Seconds())
+		}
+		writeInfluxPoint(&b, "cf_latency", base, ts, append(fields, connectionFields(r.Connections)...)...)
+
+		for _, d := range []struct {
+			direction string
+			results   []TestResult
+			p90       float64
+			perTest   float64
+		}{{"download", r.Download, r.DownloadPercentile90, r.DownloadPerTestPercentile90}, {"upload", r.Upload, r.UploadPercentile90, r.UploadPerTestPercentile90}} {
+			for _, tr := range d.results {
+				fields := []interface{}{
+					"bytes", tr.Test.NumBytes,
+					"streams", max(tr.Test.Streams, 1),
+					"succeeded", tr.Succeeded,
+					"failed", tr.Failed,
+					"timed_out", tr.TimedOut,
+				}
+				if r.Adaptive {
+					fields = append(fields, "skipped", tr.Skipped)
+				}
+				if tr.Succeeded > 0 {
+					fields = append(fields,
+						"bits_per_second", tr.BitsPerSecond,
+						"latency_seconds", tr.Latency.Seconds(),
+						"jitter_seconds", tr.Jitter.Seconds())
+					if tr.RTT > 0 {
+						fields = append(fields, "rtt_seconds", tr.RTT.Seconds())
+					}
+					if tr.SteadyBitsPerSecond > 0 {
+						fields = append(fields, "steady_bits_per_second", tr.SteadyBitsPerSecond)
+					}
+					if tr.Test.Streams > 1 {
+						fields = append(fields, "fairness", tr.Fairness)
+					}
+					fields = append(fields, connectionFields(tr.Connections)...)
+				}
+				writeInfluxPoint(&b, "cf_test", append(base, "direction", d.direction, "test", tr.Test.Name), ts, fields...)
+			}
+			writeInfluxPoint(&b, "cf_aggregate", append(base, "direction", d.direction), ts, "p90_bits_per_second", d.p90, "per_test_p90_bits_per_second", d.perTest)
+		}
+
+		for _, l := range r.LoadedLatency {
+			fields := []interface{}{
+				"load_bits_per_second", l.BitsPerSecond,
+				"succeeded", l.Succeeded,
+				"failed", l.Failed,
+				"load_succeeded", l.LoadSucceeded,
+				"load_failed", l.LoadFailed,
+			}
+			if l.Succeeded > 0 {
+				fields = append(fields,
+					"latency_seconds", l.Latency.Seconds(),
+					"jitter_seconds", l.Jitter.Seconds(),
+					"p50_seconds", l.Percentile50.Seconds(),
+					"p90_seconds", l.Percentile90.Seconds(),
+					"p99_seconds", l.Percentile99.Seconds())
+			}
+			if l.Grade != "" {
+				fields = append(fields, "increase_seconds", l.Increase.Seconds(), "grade", l.Grade)
+			}
+			writeInfluxPoint(&b, "cf_loaded_latency", append(base, "direction", l.Direction), ts, fields...)
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// connectionFields are the fields of a connection summary; the tls fields
+// are left out without tls.
+func connectionFields(c Connections) []interface{} {
+	fields := []interface{}{"protocol", c.Protocol, "reused", c.Reused}
+	if c.TLSVersion != "" {
+		fields = append(fields,
+			"tls_version", c.TLSVersion,
+			"tls_handshake_p50_seconds", c.TLSHandshake50.Seconds(),
+			"tls_handshake_p90_seconds", c.TLSHandshake90.Seconds(),
+			"tls_handshake_p99_seconds", c.TLSHandshake99.Seconds())
+	}
+	return fields
+}
+
+// sortedTags flattens tags into alternating keys and values, sorted by key.
+func sortedTags(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	flat := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		flat = append(flat, k, tags[k])
+	}
+	return flat
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	influxStringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// writeInfluxPoint writes one line; tags and fields alternate between keys and values.
+// Fields that cannot be represented, such as NaN, are left out, as are points without fields.
+func writeInfluxPoint(b *bytes.Buffer, measurement string, tags []string, ts int64, fields ...interface{}) {
+	var fs []string
+	for i := 0; i < len(fields); i += 2 {
+		key := influxTagEscaper.Replace(fields[i].(string))
+		switch v := fields[i+1].(type) {
+		case int:
+			fs = append(fs, key+"="+strconv.Itoa(v)+"i")
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			fs = append(fs, key+"="+strconv.FormatFloat(v, 'g', -1, 64))
+		case string:
+			fs = append(fs, key+`="`+influxStringEscaper.Replace(v)+`"`)
+		case bool:
+			fs = append(fs, key+"="+strconv.FormatBool(v))
+		}
+	}
+	if len(fs) == 0 {
+		return
+	}
+
+	b.WriteString(influxMeasurementEscaper.Replace(measurement))
+	for i := 0; i < len(tags); i += 2 {
+		if tags[i+1] == "" {
+			// empty tag values are not allowed
+			continue
+		}
+		b.WriteString("," + influxTagEscaper.Replace(tags[i]) + "=" + influxTagEscaper.Replace(tags[i+1]))
+	}
+	b.WriteString(" " + strings.Join(fs, ","))
+	b.WriteString(" " + strconv.FormatInt(ts, 10) + "\n")
+}
+
+// InfluxSink writes line protocol batches to the /api/v2/write endpoint of
+// InfluxDB 2. Batches that cannot be delivered are kept in BufferFile and
+// sent ahead of the next batch.
+type InfluxSink struct {
+	// URL is the base url of the InfluxDB server, e.g. http://localhost:8086.
+	URL           string
+	Org, Bucket   string
+	Token         string
+	Retries       int
+	RetryInterval time.Duration
+	// BufferFile keeps undelivered batches, separated by empty lines; no
+	// buffering if empty.
+	BufferFile string
+	// MaxBufferBytes caps the buffer; the oldest lines are dropped first.
+	MaxBufferBytes int
+	Client         *http.Client
+}
+
+func NewInfluxSink(baseURL, org, bucket, token string) *InfluxSink {
+	return &InfluxSink{
+		URL:            baseURL,
+		Org:            org,
+		Bucket:         bucket,
+		Token:          token,
+		Retries:        3,
+		RetryInterval:  time.Second,
+		MaxBufferBytes: 10 << 20,
+		Client:         &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// errRejected marks a batch the server refused to accept, such as malformed
+// or oversized line protocol; sending it again cannot succeed.
+type errRejected struct{ error }
+
+// errPermanent marks write errors that retrying right away cannot fix, such
+// as an invalid token or a missing bucket.
+type errPermanent struct{ error }
+
+// Write sends the buffered batches and then batch, one request each. A batch
+// the server rejects as invalid is dropped and its error returned. Once a
+// batch cannot be delivered, after all retries if the error is transient,
+// it is buffered together with the batches after it and the error returned.
+func (s *InfluxSink) Write(ctx context.Context, batch []byte) error {
+	u, err := parseURL(s.URL)
+	if err != nil {
+		return fmt.Errorf("influx url: %v", err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+	u.RawQuery = url.Values{"org": {s.Org}, "bucket": {s.Bucket}, "precision": {"ns"}}.Encode()
+
+	var buffered []byte
+	if s.BufferFile != "" {
+		buffered, err = os.ReadFile(s.BufferFile)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("influx buffer: %v", err)
+		}
+	}
+	batches := splitBatches(buffered)
+	if len(bytes.TrimSpace(batch)) > 0 {
+		batches = append(batches, batch)
+	}
+
+	var errs []string
+	var pending [][]byte
+	for i, b := range batches {
+		err := s.send(ctx, u, b)
+		var rejected errRejected
+		if errors.As(err, &rejected) {
+			errs = append(errs, fmt.Sprintf("%v; dropped the rejected batch of %d bytes", err, len(b)))
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+			pending = batches[i:]
+			break
+		}
+	}
+
+	switch {
+	case s.BufferFile == "":
+	case len(pending) == 0:
+		if rerr := os.Remove(s.BufferFile); rerr != nil && !errors.Is(rerr, fs.ErrNotExist) {
+			errs = append(errs, rerr.Error())
+		}
+	default:
+		data := trimLines(joinBatches(pending), s.MaxBufferBytes)
+		if berr := writeFileAtomic(s.BufferFile, data); berr != nil {
+			errs = append(errs, fmt.Sprintf("buffering failed: %v", berr))
+		} else {
+			errs = append(errs, fmt.Sprintf("buffered %d bytes in %s", len(data), s.BufferFile))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// send posts a single batch, retrying transient errors.
+func (s *InfluxSink) send(ctx context.Context, u *url.URL, data []byte) error {
+	for attempt := 0; ; attempt++ {
+		err := s.post(ctx, u, data)
+		var rejected errRejected
+		var permanent errPermanent
+		if err == nil || errors.As(err, &rejected) || errors.As(err, &permanent) || attempt >= s.Retries || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(s.RetryInterval << attempt):
+		}
+	}
+}
+
+func (s *InfluxSink) post(ctx context.Context, u *url.URL, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return errPermanent{err}
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.Token)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5:
+		return fmt.Errorf("influx write: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusRequestEntityTooLarge:
+		return errRejected{fmt.Errorf("influx write rejected: %s: %s", resp.Status, bytes.TrimSpace(msg))}
+	default:
+		// e.g. an expired token or a missing bucket, the data is fine
+		return errPermanent{fmt.Errorf("influx write: %s: %s", resp.Status, bytes.TrimSpace(msg))}
+	}
+}
+
+// splitBatches splits buffered data at empty lines.
+func splitBatches(data []byte) [][]byte {
+	var batches [][]byte
+	for _, b := range bytes.Split(data, []byte("\n\n")) {
+		b = bytes.TrimLeft(b, "\n")
+		if len(b) == 0 {
+			continue
+		}
+		if b[len(b)-1] != '\n' {
+			b = append(b, '\n')
+		}
+		batches = append(batches, b)
+	}
+	return batches
+}
+
+// joinBatches separates batches with empty lines.
+func joinBatches(batches [][]byte) []byte {
+	var b bytes.Buffer
+	for i, batch := range batches {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.Write(batch)
+		if len(batch) > 0 && batch[len(batch)-1] != '\n' {
+			b.WriteByte('\n')
+		}
+	}
+	return b.Bytes()
+}
+
+// trimLines drops whole lines from the front of data until it fits in max bytes.
+func trimLines(data []byte, max int) []byte {
+	if max <= 0 {
+		return data
+	}
+	for len(data) > max {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			return nil
+		}
+		data = data[i+1:]
+	}
+	return data
+}
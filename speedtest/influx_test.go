@@ -0,0 +1,177 @@
+package speedtest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// influxServer answers writes with the status returned by status and
+// records the bodies it was sent.
+type influxServer struct {
+	mu     sync.Mutex
+	bodies []string
+	status func(body string, n int) int
+}
+
+func (s *influxServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	s.bodies = append(s.bodies, string(body))
+	code := s.status(string(body), len(s.bodies))
+	s.mu.Unlock()
+	w.WriteHeader(code)
+}
+
+func newTestSink(t *testing.T, status func(body string, n int) int) (*InfluxSink, *influxServer) {
+	t.Helper()
+	is := &influxServer{status: status}
+	srv := httptest.NewServer(is)
+	t.Cleanup(srv.Close)
+	sink := NewInfluxSink(srv.URL, "org", "bucket", "token")
+	sink.RetryInterval = time.Millisecond
+	sink.BufferFile = filepath.Join(t.TempDir(), "buffer")
+	return sink, is
+}
+
+func readBuffer(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestInfluxSinkRetries(t *testing.T) {
+	sink, is := newTestSink(t, func(_ string, n int) int {
+		if n < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusNoContent
+	})
+	if err := sink.Write(context.Background(), []byte("m v=1 1\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if len(is.bodies) != 3 {
+		t.Errorf("got %d requests, want 3", len(is.bodies))
+	}
+	if b := readBuffer(t, sink.BufferFile); b != "" {
+		t.Errorf("buffer = %q, want none", b)
+	}
+}
+
+func TestInfluxSinkBuffers(t *testing.T) {
+	down := true
+	sink, is := newTestSink(t, func(string, int) int {
+		if down {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusNoContent
+	})
+	sink.Retries = 1
+
+	if err := sink.Write(context.Background(), []byte("m v=1 1\n")); err == nil {
+		t.Fatal("Write to an unavailable server succeeded")
+	}
+	if err := sink.Write(context.Background(), []byte("m v=2 2\n")); err == nil {
+		t.Fatal("Write to an unavailable server succeeded")
+	}
+	if b, want := readBuffer(t, sink.BufferFile), "m v=1 1\n\nm v=2 2\n"; b != want {
+		t.Fatalf("buffer = %q, want %q", b, want)
+	}
+
+	down = false
+	is.bodies = nil
+	if err := sink.Write(context.Background(), []byte("m v=3 3\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	want := []string{"m v=1 1\n", "m v=2 2\n", "m v=3 3\n"}
+	if strings.Join(is.bodies, "|") != strings.Join(want, "|") {
+		t.Errorf("sent %q, want %q", is.bodies, want)
+	}
+	if b := readBuffer(t, sink.BufferFile); b != "" {
+		t.Errorf("buffer = %q, want none", b)
+	}
+}
+
+func TestInfluxSinkDropsRejectedBatch(t *testing.T) {
+	for _, code := range []int{http.StatusBadRequest, http.StatusRequestEntityTooLarge} {
+		sink, is := newTestSink(t, func(body string, _ int) int {
+			if strings.Contains(body, "bad") {
+				return code
+			}
+			return http.StatusNoContent
+		})
+		if err := os.WriteFile(sink.BufferFile, []byte("bad v= 1\n\nm v=2 2\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		err := sink.Write(context.Background(), []byte("m v=3 3\n"))
+		if err == nil || !strings.Contains(err.Error(), "dropped") {
+			t.Errorf("%d: Write = %v, want the dropped batch reported", code, err)
+		}
+		want := []string{"bad v= 1\n", "m v=2 2\n", "m v=3 3\n"}
+		if strings.Join(is.bodies, "|") != strings.Join(want, "|") {
+			t.Errorf("%d: sent %q, want %q", code, is.bodies, want)
+		}
+		if b := readBuffer(t, sink.BufferFile); b != "" {
+			t.Errorf("%d: buffer = %q, want none", code, b)
+		}
+	}
+}
+
+func TestInfluxSinkKeepsBufferOnAuthErrors(t *testing.T) {
+	for _, code := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound} {
+		sink, is := newTestSink(t, func(string, int) int { return code })
+		if err := os.WriteFile(sink.BufferFile, []byte("m v=1 1\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Write(context.Background(), []byte("m v=2 2\n")); err == nil {
+			t.Errorf("%d: Write succeeded", code)
+		}
+		if len(is.bodies) != 1 {
+			t.Errorf("%d: got %d requests, want 1 without retries", code, len(is.bodies))
+		}
+		if b, want := readBuffer(t, sink.BufferFile), "m v=1 1\n\nm v=2 2\n"; b != want {
+			t.Errorf("%d: buffer = %q, want %q", code, b, want)
+		}
+	}
+}
+
+func TestInfluxSinkTrimsBuffer(t *testing.T) {
+	sink, _ := newTestSink(t, func(string, int) int { return http.StatusServiceUnavailable })
+	sink.Retries = 0
+	sink.MaxBufferBytes = 16
+	for _, batch := range []string{"m v=1 1\n", "m v=2 2\n", "m v=3 3\n"} {
+		sink.Write(context.Background(), []byte(batch))
+	}
+	if b, want := readBuffer(t, sink.BufferFile), "m v=3 3\n"; !strings.HasSuffix(b, want) || len(b) > 16 {
+		t.Errorf("buffer = %q, want at most 16 bytes ending in %q", b, want)
+	}
+}
+
+func TestWriteInfluxReservedTags(t *testing.T) {
+	r := &Result{Target: "http://example.com", Family: FamilyIPv4, Start: time.Unix(1, 0)}
+	for _, tag := range []string{"target", "family", "direction", "test"} {
+		if err := WriteInflux(io.Discard, map[string]string{tag: "x"}, r); err == nil {
+			t.Errorf("WriteInflux accepted the reserved tag %q", tag)
+		}
+	}
+	var b strings.Builder
+	if err := WriteInflux(&b, map[string]string{"site": "ams"}, r); err != nil {
+		t.Fatalf("WriteInflux: %v", err)
+	}
+	if !strings.Contains(b.String(), "cf_latency,site=ams,target=example.com,family=ipv4 ") {
+		t.Errorf("missing tags in %q", b.String())
+	}
+}
@@ -0,0 +1,156 @@
+package speedtest
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"time"
+)
+
+// maxRedirects bounds the redirects followed by Inspect.
+const maxRedirects = 10
+
+// InspectOptions configures a single request made by Inspect.
+type InspectOptions struct {
+	// Method defaults to GET, or POST if Body is set.
+	Method string
+	// Body is sent as the request body; "@file" sends the contents of file.
+	Body string
+	// FollowRedirects follows up to 10 redirects.
+	FollowRedirects bool
+	// OnlyHeader sends a HEAD request.
+	OnlyHeader bool
+	// SaveOutput saves the body under its remote name, OutputFile under the given name.
+	SaveOutput bool
+	OutputFile string
+}
+
+// Inspect requests rawurl once and writes the connection, the response
+// headers and the duration of every phase to w. It uses the network, tls and
+// header settings of s.
+func (s *Speedtest) Inspect(ctx context.Context, w io.Writer, rawurl string, o InspectOptions) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	if s.Family == FamilyBoth {
+		return fmt.Errorf("inspect makes a single request, choose %s or %s", FamilyIPv4, FamilyIPv6)
+	}
+	certificates, err := readClientCert(s.ClientCertFile)
+	if err != nil {
+		return err
+	}
+
+	method, body := o.Method, o.Body
+	switch {
+	case o.OnlyHeader:
+		method = http.MethodHead
+	case method == "" && body != "":
+		method = http.MethodPost
+	case method == "":
+		method = http.MethodGet
+	}
+
+	for redirectsFollowed := 0; ; redirectsFollowed++ {
+		u, err := normalizeURL(rawurl)
+		if err != nil {
+			return err
+		}
+		req, err := newRequest(method, u, body, s.Headers)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", userAgent)
+
+		var t0, t1, t2, t3, t4, t5, t6 time.Time
+		var remote string
+		trace := &httptrace.ClientTrace{
+			DNSStart: func(_ httptrace.DNSStartInfo) { t0 = time.Now() },
+			DNSDone:  func(_ httptrace.DNSDoneInfo) { t1 = time.Now() },
+			ConnectStart: func(_, _ string) {
+				if t1.IsZero() {
+					// connecting to IP
+					t1 = time.Now()
+				}
+			},
+			ConnectDone: func(_, addr string, err error) {
+				if err == nil {
+					remote = addr
+				}
+				t2 = time.Now()
+			},
+			GotConn:              func(_ httptrace.GotConnInfo) { t3 = time.Now() },
+			GotFirstResponseByte: func() { t4 = time.Now() },
+			TLSHandshakeStart:    func() { t5 = time.Now() },
+			TLSHandshakeDone:     func(_ tls.ConnectionState, _ error) { t6 = time.Now() },
+		}
+		req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+
+		client, t := s.newClient(u, req.Host, certificates)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.CloseIdleConnections()
+			return err
+		}
+		msg, err := readResponseBody(req, resp, o.SaveOutput, o.OutputFile)
+		resp.Body.Close()
+		t.CloseIdleConnections()
+		t7 := time.Now() // after read body
+		if err != nil {
+			return err
+		}
+		if t0.IsZero() {
+			// we skipped DNS
+			t0 = t1
+		}
+
+		fmt.Fprintf(w, "Connected to %s\n", remote)
+		if resp.TLS != nil {
+			fmt.Fprintf(w, "%s, %s, ALPN %q\n", tls.VersionName(resp.TLS.Version), tls.CipherSuiteName(resp.TLS.CipherSuite), resp.TLS.NegotiatedProtocol)
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "%s %s\n", resp.Proto, resp.Status)
+		names := make(Headers, 0, len(resp.Header))
+		for k := range resp.Header {
+			names = append(names, k)
+		}
+		sort.Sort(names)
+		for _, k := range names {
+			for _, v := range resp.Header[k] {
+				fmt.Fprintf(w, "%s: %s\n", k, v)
+			}
+		}
+		if msg != "" {
+			fmt.Fprintf(w, "\n%s\n", msg)
+		}
+
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "dns_lookup        %v\n", t1.Sub(t0))
+		fmt.Fprintf(w, "tcp_connection    %v\n", t2.Sub(t1))
+		if !t5.IsZero() {
+			fmt.Fprintf(w, "tls_handshake     %v\n", t6.Sub(t5))
+		}
+		fmt.Fprintf(w, "server_processing %v\n", t4.Sub(t3))
+		fmt.Fprintf(w, "content_transfer  %v\n", t7.Sub(t4))
+		fmt.Fprintf(w, "total             %v\n", t7.Sub(t0))
+
+		if !o.FollowRedirects || !isRedirect(resp) {
+			return nil
+		}
+		if redirectsFollowed >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		loc, err := resp.Location()
+		if err != nil {
+			return err
+		}
+		rawurl = loc.String()
+		if resp.StatusCode == http.StatusSeeOther || (method == http.MethodPost && resp.StatusCode < http.StatusTemporaryRedirect) {
+			method, body = http.MethodGet, ""
+		}
+		fmt.Fprintf(w, "\nRedirected to %s\n\n", rawurl)
+	}
+}
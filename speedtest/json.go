@@ -0,0 +1,514 @@
+package speedtest
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"time"
+)
+
+// JSONSchemaVersion is the version of the document written by WriteJSON.
+// It is increased whenever a field is renamed, removed or changes meaning;
+// new fields may be added without changing it.
+const JSONSchemaVersion = 1
+
+// WriteJSON writes results as a single JSON document:
+//
+//	{
+//	  "schema_version": 1,
+//	  "runs": [{
+//	    "start_timestamp": 1700000000,          // unix seconds
+//	    "start_time": "2023-11-14T22:13:20Z",   // RFC 3339
+//	    "end_time": "2023-11-14T22:13:35Z",
+//	    "target": "http://speed.cloudflare.com",
+//	    "family": "ipv4",                      // or "ipv6"
+//	    "unreachable": "",                     // reason, if the server could not be reached over family
+//	    "plan": {
+//	      "latency_reps": 20,
+//	      "adaptive": false,                   // sizes tried adaptively, see below
+//	      "download": [{"name": "100kB", "bytes": 101000, "iterations": 10, "streams": 1}],
+//	      "upload": [...]
+//	    },
+//	    "latency": {
+//	      "latency_seconds": 0.012, "jitter_seconds": 0.001, "dns_seconds": 0.002,
+//	      "rtt_seconds": 0.011,                // server_seconds minus server timing, null without Server-Timing
+//	      "samples": [<sample>]
+//	    },
+//	    "connections": <connections>,         // over every iteration of the run
+//	    "download": [{
+//	      "name": "100kB", "bytes": 101000, "iterations": 10, "streams": 1,
+//	      "bits_per_second": 9.1e7, "latency_seconds": 0.05, "jitter_seconds": 0.001,
+//	      "steady_bits_per_second": 9.4e7,    // after ramp-up, null if the transfers were too short
+//	      "rtt_seconds": 0.011,                // downloads with Server-Timing only
+//	      "fairness": null,                    // Jain's index, multi-stream tests only
+//	      "succeeded": 10, "failed": 0, "timed_out": 0,
+//	      "skipped": false,                   // adaptive runs: too short to measure
+//	      "connections": <connections>,
+//	      "samples": [<sample>]
+//	    }],
+//	    "upload": [...],
+//	    "loaded_latency": [{                  // empty unless measured
+//	      "direction": "download",
+//	      "latency_seconds": 0.09, "jitter_seconds": 0.02,
+//	      "p50_seconds": 0.08, "p90_seconds": 0.15, "p99_seconds": 0.2,
+//	      "increase_seconds": 0.078, "load_bits_per_second": 9.4e7, "grade": "C",
+//	      "succeeded": 50, "failed": 0,      // latency probes
+//	      "load_succeeded": 12, "load_failed": 0,
+//	      "samples": [<sample>]
+//	    }],
+//	    "bufferbloat_grade": "C",
+//	    "aggregate": {
+//	      "download_p90_bits_per_second": 9.5e7,  // over every iteration of at least min_duration_seconds
+//	      "upload_p90_bits_per_second": 4.1e7,
+//	      "min_duration_seconds": 0.01,
+//	      "download_per_test_p90_bits_per_second": 9.3e7,  // over the per test throughput
+//	      "upload_per_test_p90_bits_per_second": 4e7
+//	    }
+//	  }]
+//	}
+//
+// Connections summarize the connections of the successful iterations;
+// protocol and tls_version list the distinct values seen, separated by commas:
+//
+//	{"protocol": "HTTP/2.0", "tls_version": "TLS 1.3", "reused": 0,
+//	 "tls_handshake_p50_seconds": 0.005, "tls_handshake_p90_seconds": 0.006,
+//	 "tls_handshake_p99_seconds": 0.008}
+//
+// A sample holds the phase timings of one iteration, in seconds, and the
+// details of its connection:
+//
+//	{"iteration": 0, "dns_seconds": 0.002, "connect_seconds": 0.004, "tcp_seconds": 0.01,
+//	 "tls_seconds": 0.005, "server_seconds": 0.011, "ttfb_seconds": 0.027,
+//	 "transfer_seconds": 0.02, "total_seconds": 0.045,
+//	 "server_timing_seconds": 0.001, "rtt_seconds": 0.01, "raw_transfer_seconds": 0.02,
+//	 "bytes": 101000, "steady_bits_per_second": 0,
+//	 "progress": [{"elapsed_seconds": 0, "bytes": 0}, {"elapsed_seconds": 0.1, "bytes": 65536}, ...],
+//	 "status": 200, "phase": "", "error": "", "timed_out": false,
+//	 "protocol": "HTTP/2.0", "tls_version": "TLS 1.3", "cipher_suite": "TLS_AES_128_GCM_SHA256",
+//	 "alpn": "h2", "reused": false, "was_idle": false, "idle_seconds": 0}
+//
+// progress samples the bytes moved every progress interval from the first
+// byte on. It starts at zero and ends with the last byte, so a transfer
+// shorter than one interval has just those two points. It is left out when
+// progress is disabled and for multi-stream samples, whose streams carry
+// their own.
+//
+// For multi-stream samples "bytes" counts the bytes moved while all streams
+// were transferring; they also carry "fairness" and "streams", the samples
+// of the individual streams.
+//
+// server_timing_seconds is the processing time the server reported in its
+// Server-Timing header. When it is reported, rtt_seconds is server_seconds
+// without it, and transfer_seconds of uploads excludes it; server_seconds and
+// raw_transfer_seconds are always as measured.
+//
+// Adaptive runs list every planned test under plan, but under download and
+// upload only the ones that were tried, smallest first.
+//
+// tcp_seconds includes connect_seconds and tls_seconds; server_seconds runs
+// from the connection being ready until the first response byte and
+// ttfb_seconds from the start of the request, including dns, connect and
+// tls of a new connection, until the first response byte. Failed
+// iterations only carry iteration, status, phase, error and timed_out.
+// Aggregates that could not be computed are null. Runs over both address
+// families have one entry per family.
+func WriteJSON(w io.Writer, results ...*Result) error {
+	doc := jsonDocument{SchemaVersion: JSONSchemaVersion, Runs: []jsonRun{}}
+	for _, r := range results {
+		doc.Runs = append(doc.Runs, newJSONRun(r))
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+type jsonDocument struct {
+	SchemaVersion int       `json:"schema_version"`
+	Runs          []jsonRun `json:"runs"`
+}
+
+type jsonRun struct {
+	StartTimestamp int64            `json:"start_timestamp"`
+	StartTime      time.Time        `json:"start_time"`
+	EndTime        time.Time        `json:"end_time"`
+	Target         string           `json:"target"`
+	Family         string           `json:"family"`
+	Unreachable    string           `json:"unreachable"`
+	Plan           jsonPlan         `json:"plan"`
+	Latency        jsonLatency      `json:"latency"`
+	Connections    jsonConnections  `json:"connections"`
+	Download       []jsonTestResult `json:"download"`
+	Upload         []jsonTestResult `json:"upload"`
+	LoadedLatency  []jsonLoaded     `json:"loaded_latency"`
+	Bufferbloat    string           `json:"bufferbloat_grade"`
+	Aggregate      jsonAggregate    `json:"aggregate"`
+}
+
+type jsonPlan struct {
+	LatencyReps int        `json:"latency_reps"`
+	Adaptive    bool       `json:"adaptive"`
+	Download    []jsonTest `json:"download"`
+	Upload      []jsonTest `json:"upload"`
+}
+
+type jsonTest struct {
+	Name       string `json:"name"`
+	Bytes      int    `json:"bytes"`
+	Iterations int    `json:"iterations"`
+	Streams    int    `json:"streams"`
+}
+
+type jsonLatency struct {
+	Latency float64      `json:"latency_seconds"`
+	Jitter  float64      `json:"jitter_seconds"`
+	DNS     float64      `json:"dns_seconds"`
+	RTT     *float64     `json:"rtt_seconds"`
+	Samples []jsonSample `json:"samples"`
+}
+
+type jsonTestResult struct {
+	jsonTest
+	BitsPerSecond *float64        `json:"bits_per_second"`
+	Latency       float64         `json:"latency_seconds"`
+	Jitter        float64         `json:"jitter_seconds"`
+	Steady        *float64        `json:"steady_bits_per_second"`
+	RTT           *float64        `json:"rtt_seconds"`
+	Fairness      *float64        `json:"fairness"`
+	Succeeded     int             `json:"succeeded"`
+	Failed        int             `json:"failed"`
+	TimedOut      int             `json:"timed_out"`
+	Skipped       bool            `json:"skipped"`
+	Connections   jsonConnections `json:"connections"`
+	Samples       []jsonSample    `json:"samples"`
+}
+
+type jsonConnections struct {
+	Protocol       string  `json:"protocol"`
+	TLSVersion     string  `json:"tls_version"`
+	Reused         int     `json:"reused"`
+	TLSHandshake50 float64 `json:"tls_handshake_p50_seconds"`
+	TLSHandshake90 float64 `json:"tls_handshake_p90_seconds"`
+	TLSHandshake99 float64 `json:"tls_handshake_p99_seconds"`
+}
+
+type jsonLoaded struct {
+	Direction     string       `json:"direction"`
+	Latency       float64      `json:"latency_seconds"`
+	Jitter        float64      `json:"jitter_seconds"`
+	P50           float64      `json:"p50_seconds"`
+	P90           float64      `json:"p90_seconds"`
+	P99           float64      `json:"p99_seconds"`
+	Increase      float64      `json:"increase_seconds"`
+	BitsPerSecond float64      `json:"load_bits_per_second"`
+	Grade         string       `json:"grade"`
+	Succeeded     int          `json:"succeeded"`
+	Failed        int          `json:"failed"`
+	LoadSucceeded int          `json:"load_succeeded"`
+	LoadFailed    int          `json:"load_failed"`
+	Samples       []jsonSample `json:"samples"`
+}
+
+type jsonSample struct {
+	Iteration int     `json:"iteration"`
+	DNS       float64 `json:"dns_seconds"`
+	Connect   float64 `json:"connect_seconds"`
+	TCP       float64 `json:"tcp_seconds"`
+	TLS       float64 `json:"tls_seconds"`
+	Server    float64 `json:"server_seconds"`
+	TTFB      float64 `json:"ttfb_seconds"`
+	Transfer  float64 `json:"transfer_seconds"`
+	Total     float64 `json:"total_seconds"`
+
+	ServerTiming float64 `json:"server_timing_seconds"`
+	RTT          float64 `json:"rtt_seconds"`
+	RawTransfer  float64 `json:"raw_transfer_seconds"`
+
+	Status   int    `json:"status"`
+	Phase    string `json:"phase"`
+	Error    string `json:"error"`
+	TimedOut bool   `json:"timed_out"`
+
+	Protocol    string  `json:"protocol"`
+	TLSVersion  string  `json:"tls_version"`
+	CipherSuite string  `json:"cipher_suite"`
+	ALPN        string  `json:"alpn"`
+	Reused      bool    `json:"reused"`
+	WasIdle     bool    `json:"was_idle"`
+	IdleTime    float64 `json:"idle_seconds"`
+
+	Bytes    int64          `json:"bytes"`
+	Steady   float64        `json:"steady_bits_per_second"`
+	Progress []jsonProgress `json:"progress,omitempty"`
+	Fairness float64        `json:"fairness,omitempty"`
+	Streams  []jsonSample   `json:"streams,omitempty"`
+}
+
+type jsonProgress struct {
+	Elapsed float64 `json:"elapsed_seconds"`
+	Bytes   int64   `json:"bytes"`
+}
+
+type jsonAggregate struct {
+	DownloadPercentile90        *float64 `json:"download_p90_bits_per_second"`
+	UploadPercentile90          *float64 `json:"upload_p90_bits_per_second"`
+	MinDuration                 float64  `json:"min_duration_seconds"`
+	DownloadPerTestPercentile90 *float64 `json:"download_per_test_p90_bits_per_second"`
+	UploadPerTestPercentile90   *float64 `json:"upload_per_test_p90_bits_per_second"`
+}
+
+func newJSONRun(r *Result) jsonRun {
+	run := jsonRun{
+		StartTimestamp: r.Start.Unix(),
+		StartTime:      r.Start,
+		EndTime:        r.End,
+		Target:         r.Target,
+		Family:         r.Family,
+		Unreachable:    r.Unreachable,
+		Plan: jsonPlan{
+			LatencyReps: r.LatencyReps,
+			Adaptive:    r.Adaptive,
+			Download:    newJSONTests(r.DownloadTests),
+			Upload:      newJSONTests(r.UploadTests),
+		},
+		Latency: jsonLatency{
+			Latency: r.Latency.Seconds(),
+			Jitter:  r.Jitter.Seconds(),
+			DNS:     r.DNSTime.Seconds(),
+			RTT:     jsonDuration(r.RTT),
+			Samples: newJSONSamples(r.LatencySamples),
+		},
+		Connections:   newJSONConnections(r.Connections),
+		Download:      newJSONTestResults(r.Download),
+		Upload:        newJSONTestResults(r.Upload),
+		LoadedLatency: []jsonLoaded{},
+		Bufferbloat:   r.BufferbloatGrade,
+		Aggregate: jsonAggregate{
+			DownloadPercentile90:        jsonNumber(r.DownloadPercentile90),
+			UploadPercentile90:          jsonNumber(r.UploadPercentile90),
+			MinDuration:                 r.BandwidthMinDuration.Seconds(),
+			DownloadPerTestPercentile90: jsonNumber(r.DownloadPerTestPercentile90),
+			UploadPerTestPercentile90:   jsonNumber(r.UploadPerTestPercentile90),
+		},
+	}
+	for _, l := range r.LoadedLatency {
+		run.LoadedLatency = append(run.LoadedLatency, jsonLoaded{
+			Direction:     l.Direction,
+			Latency:       l.Latency.Seconds(),
+			Jitter:        l.Jitter.Seconds(),
+			P50:           l.Percentile50.Seconds(),
+			P90:           l.Percentile90.Seconds(),
+			P99:           l.Percentile99.Seconds(),
+			Increase:      l.Increase.Seconds(),
+			BitsPerSecond: l.BitsPerSecond,
+			Grade:         l.Grade,
+			Succeeded:     l.Succeeded,
+			Failed:        l.Failed,
+			LoadSucceeded: l.LoadSucceeded,
+			LoadFailed:    l.LoadFailed,
+			Samples:       newJSONSamples(l.Samples),
+		})
+	}
+	return run
+}
+
+func newJSONTests(tests []Test) []jsonTest {
+	out := []jsonTest{}
+	for _, t := range tests {
+		out = append(out, newJSONTest(t))
+	}
+	return out
+}
+
+func newJSONTest(t Test) jsonTest {
+	streams := t.Streams
+	if streams < 1 {
+		streams = 1
+	}
+	return jsonTest{Name: t.Name, Bytes: t.NumBytes, Iterations: t.Iterations, Streams: streams}
+}
+
+func newJSONTestResults(results []TestResult) []jsonTestResult {
+	out := []jsonTestResult{}
+	for _, tr := range results {
+		jtr := jsonTestResult{
+			jsonTest:    newJSONTest(tr.Test),
+			Latency:     tr.Latency.Seconds(),
+			Jitter:      tr.Jitter.Seconds(),
+			RTT:         jsonDuration(tr.RTT),
+			Succeeded:   tr.Succeeded,
+			Failed:      tr.Failed,
+			TimedOut:    tr.TimedOut,
+			Skipped:     tr.Skipped,
+			Connections: newJSONConnections(tr.Connections),
+			Samples:     newJSONSamples(tr.Samples),
+		}
+		if tr.Succeeded > 0 {
+			jtr.BitsPerSecond = jsonNumber(tr.BitsPerSecond)
+			if tr.SteadyBitsPerSecond > 0 {
+				jtr.Steady = jsonNumber(tr.SteadyBitsPerSecond)
+			}
+			if tr.Test.Streams > 1 && tr.Fairness > 0 {
+				jtr.Fairness = jsonNumber(tr.Fairness)
+			}
+		}
+		out = append(out, jtr)
+	}
+	return out
+}
+
+func newJSONSamples(samples []Sample) []jsonSample {
+	out := []jsonSample{}
+	for _, x := range samples {
+		js := jsonSample{
+			Iteration:    x.Iteration,
+			DNS:          x.DNS.Seconds(),
+			Connect:      x.Connect.Seconds(),
+			TCP:          x.TCP.Seconds(),
+			TLS:          x.TLS.Seconds(),
+			Server:       x.Server.Seconds(),
+			TTFB:         x.TTFB.Seconds(),
+			Transfer:     x.Transfer.Seconds(),
+			Total:        x.Full.Seconds(),
+			ServerTiming: x.ServerTiming.Seconds(),
+			RTT:          x.RTT.Seconds(),
+			RawTransfer:  x.RawTransfer.Seconds(),
+			Status:       x.Status,
+			Phase:        x.Phase,
+			TimedOut:     x.TimedOut,
+			Protocol:     x.Proto,
+			TLSVersion:   x.TLSVersion,
+			CipherSuite:  x.CipherSuite,
+			ALPN:         x.ALPN,
+			Reused:       x.Reused,
+			WasIdle:      x.WasIdle,
+			IdleTime:     x.IdleTime.Seconds(),
+			Bytes:        x.Bytes,
+			Steady:       x.SteadyBitsPerSecond,
+			Fairness:     x.Fairness,
+		}
+		if len(x.Streams) > 0 {
+			js.Streams = newJSONSamples(x.Streams)
+		}
+		for _, p := range x.Progress {
+			js.Progress = append(js.Progress, jsonProgress{Elapsed: p.Elapsed.Seconds(), Bytes: p.Bytes})
+		}
+		if x.Err != nil {
+			js.Error = x.Err.Error()
+		}
+		out = append(out, js)
+	}
+	return out
+}
+
+func newJSONConnections(c Connections) jsonConnections {
+	return jsonConnections{
+		Protocol:       c.Protocol,
+		TLSVersion:     c.TLSVersion,
+		Reused:         c.Reused,
+		TLSHandshake50: c.TLSHandshake50.Seconds(),
+		TLSHandshake90: c.TLSHandshake90.Seconds(),
+		TLSHandshake99: c.TLSHandshake99.Seconds(),
+	}
+}
+
+// jsonNumber returns nil for values JSON cannot represent.
+func jsonNumber(f float64) *float64 {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil
+	}
+	return &f
+}
+
+// jsonDuration is d in seconds, or null if it was not measured.
+func jsonDuration(d time.Duration) *float64 {
+	if d <= 0 {
+		return nil
+	}
+	return jsonNumber(d.Seconds())
+}
+
+// WriteRPMJSON writes the result of a responsiveness test as a JSON document:
+//
+//	{
+//	  "schema_version": 1,
+//	  "start_time": "2023-11-14T22:13:20Z",
+//	  "end_time": "2023-11-14T22:13:55Z",
+//	  "config_url": "https://speed.example.com/.well-known/nq",
+//	  "responsiveness": [{
+//	    "direction": "download",
+//	    "rpm": 1200, "foreign_rpm": 1500, "self_rpm": 1000,
+//	    "tcp_seconds": 0.01, "tls_seconds": 0.02, "http_seconds": 0.05, "self_seconds": 0.06,
+//	    "bits_per_second": 9.4e8, "connections": 8, "saturated": true,
+//	    "duration_seconds": 9.2, "self_reused": 80,
+//	    "load_succeeded": 8, "load_failed": 0, "load_error": "",
+//	    "foreign_probes": [<sample>], "self_probes": [<sample>]
+//	  }]
+//	}
+//
+// Samples have the same shape as in WriteJSON.
+func WriteRPMJSON(w io.Writer, r *RPMResult) error {
+	doc := jsonRPMDocument{
+		SchemaVersion:  JSONSchemaVersion,
+		StartTime:      r.Start,
+		EndTime:        r.End,
+		ConfigURL:      r.ConfigURL,
+		Responsiveness: []jsonResponsiveness{},
+	}
+	for _, d := range []Responsiveness{r.Download, r.Upload} {
+		if d.Direction == "" {
+			continue
+		}
+		doc.Responsiveness = append(doc.Responsiveness, jsonResponsiveness{
+			Direction:     d.Direction,
+			RPM:           d.RPM,
+			ForeignRPM:    d.ForeignRPM,
+			SelfRPM:       d.SelfRPM,
+			TCP:           d.TCP.Seconds(),
+			TLS:           d.TLS.Seconds(),
+			HTTP:          d.HTTP.Seconds(),
+			Self:          d.Self.Seconds(),
+			BitsPerSecond: d.BitsPerSecond,
+			Connections:   d.Connections,
+			Saturated:     d.Saturated,
+			Duration:      d.Duration.Seconds(),
+			SelfReused:    d.SelfReused,
+			LoadSucceeded: d.LoadSucceeded,
+			LoadFailed:    d.LoadFailed,
+			LoadError:     d.LoadError,
+			ForeignProbes: newJSONSamples(d.ForeignProbes),
+			SelfProbes:    newJSONSamples(d.SelfProbes),
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+type jsonRPMDocument struct {
+	SchemaVersion  int                  `json:"schema_version"`
+	StartTime      time.Time            `json:"start_time"`
+	EndTime        time.Time            `json:"end_time"`
+	ConfigURL      string               `json:"config_url"`
+	Responsiveness []jsonResponsiveness `json:"responsiveness"`
+}
+
+type jsonResponsiveness struct {
+	Direction     string       `json:"direction"`
+	RPM           float64      `json:"rpm"`
+	ForeignRPM    float64      `json:"foreign_rpm"`
+	SelfRPM       float64      `json:"self_rpm"`
+	TCP           float64      `json:"tcp_seconds"`
+	TLS           float64      `json:"tls_seconds"`
+	HTTP          float64      `json:"http_seconds"`
+	Self          float64      `json:"self_seconds"`
+	BitsPerSecond float64      `json:"bits_per_second"`
+	Connections   int          `json:"connections"`
+	Saturated     bool         `json:"saturated"`
+	Duration      float64      `json:"duration_seconds"`
+	SelfReused    int          `json:"self_reused"`
+	LoadSucceeded int          `json:"load_succeeded"`
+	LoadFailed    int          `json:"load_failed"`
+	LoadError     string       `json:"load_error"`
+	ForeignProbes []jsonSample `json:"foreign_probes"`
+	SelfProbes    []jsonSample `json:"self_probes"`
+}
@@ -0,0 +1,249 @@
+package speedtest
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cfspeedtest/stats"
+)
+
+// LoadedLatency holds the latency probes sent while a download or upload
+// saturated the link.
+type LoadedLatency struct {
+	// Direction is "download" or "upload".
+	Direction string
+	Samples   []Sample
+
+	// Latency and Jitter are the average and corrected standard deviation
+	// of the tcp connection times of the probes, like the idle numbers.
+	Latency, Jitter time.Duration
+	// Percentile50, Percentile90 and Percentile99 are percentiles of the
+	// tcp connection times of the probes.
+	Percentile50, Percentile90, Percentile99 time.Duration
+	// Increase is Latency minus the idle latency of the run.
+	Increase time.Duration
+	// BitsPerSecond is the throughput of the load, counting only the
+	// transfers the server accepted.
+	BitsPerSecond float64
+	// Grade is the bufferbloat grade of Increase, see BufferbloatGrade.
+	// Without a successful load transfer there is no grade.
+	Grade string
+
+	// Succeeded and Failed count the latency probes, LoadSucceeded and
+	// LoadFailed the load transfers, see generateLoad.
+	Succeeded, Failed         int
+	LoadSucceeded, LoadFailed int
+}
+
+const (
+	// minLoadBackoff and maxLoadBackoff bound the wait before a failed load
+	// transfer is retried; it doubles with every failure in a row.
+	minLoadBackoff = 100 * time.Millisecond
+	maxLoadBackoff = 2 * time.Second
+)
+
+// loadCounter counts the load transfers of a measurement.
+type loadCounter struct {
+	mu                sync.Mutex
+	succeeded, failed int
+	// err is the error of the last failed transfer.
+	err error
+}
+
+func (c *loadCounter) add(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.failed++
+		c.err = err
+	} else {
+		c.succeeded++
+	}
+}
+
+// check returns an error if no load transfer succeeded.
+func (c *loadCounter) check() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.succeeded > 0:
+		return nil
+	case c.err != nil:
+		return fmt.Errorf("no load transfer succeeded, %d failed, the last with: %v", c.failed, c.err)
+	default:
+		return fmt.Errorf("no load transfer succeeded")
+	}
+}
+
+// generateLoad repeats load transfers until ctx is done and counts them
+// into c. A transfer succeeds if it completes, or if the end of the load
+// cuts it off after it moved bytes the server did not reject. A failed
+// transfer is retried after a backoff. IterationTimeout does not apply, the
+// load ends with ctx.
+func (s *Speedtest) generateLoad(ctx context.Context, target *url.URL, certificates []tls.Certificate, client *http.Client, newReq func() (*http.Request, error), w *streamWindow, c *loadCounter) {
+	unbounded := *s
+	s = &unbounded
+	s.IterationTimeout = 0
+	var backoff time.Duration
+	for ctx.Err() == nil {
+		x := s.iteration(ctx, target, certificates, client, newReq, w)
+		switch {
+		case x.OK(), ctx.Err() != nil && x.Bytes > 0 && (x.Status == 0 || x.Status == http.StatusOK):
+			c.add(nil)
+			backoff = 0
+		case ctx.Err() != nil:
+			// cut off before it moved anything
+		default:
+			c.add(x.Err)
+			backoff = min(max(2*backoff, minLoadBackoff), maxLoadBackoff)
+			t := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+			case <-t.C:
+			}
+			t.Stop()
+		}
+	}
+}
+
+// LoadedLatency saturates the link in direction, "download" or "upload",
+// for LoadDuration and measures latency in the meantime. Increase and Grade
+// are only set once the result is added to a run with an idle latency. If
+// no load transfer succeeded, the result is returned with an error.
+func (s *Speedtest) LoadedLatency(ctx context.Context, direction string) (*LoadedLatency, error) {
+	certificates, err := readClientCert(s.ClientCertFile)
+	if err != nil {
+		return nil, err
+	}
+	latency_url, err := s.endpoint(s.LatencyPath, url.Values{"bytes": {"0"}})
+	if err != nil {
+		return nil, err
+	}
+	var load_url *url.URL
+	var newLoadReq func() (*http.Request, error)
+	switch direction {
+	case "download":
+		load_url, err = s.endpoint(s.DownloadPath, url.Values{"bytes": {strconv.Itoa(s.LoadBytes)}})
+		newLoadReq = func() (*http.Request, error) { return http.NewRequest("GET", load_url.String(), nil) }
+	case "upload":
+		load_url, err = s.endpoint(s.UploadPath, nil)
+		newLoadReq = func() (*http.Request, error) { return newUploadRequest(load_url, s.LoadBytes) }
+	default:
+		return nil, fmt.Errorf("unknown direction %q", direction)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the load runs until the last probe has returned
+	loadCtx, stopLoad := context.WithCancel(ctx)
+	defer stopLoad()
+	w := &streamWindow{streams: s.LoadStreams}
+	var counter loadCounter
+	var load sync.WaitGroup
+	for i := 0; i < s.LoadStreams; i++ {
+		load.Add(1)
+		go func() {
+			defer load.Done()
+			s.generateLoad(loadCtx, load_url, certificates, nil, newLoadReq, w, &counter)
+		}()
+	}
+
+	var (
+		probes sync.WaitGroup
+		mu     sync.Mutex
+		all    []Sample
+	)
+	deadline := time.NewTimer(s.LoadDuration)
+	defer deadline.Stop()
+	ticker := time.NewTicker(s.LoadProbeInterval)
+	defer ticker.Stop()
+probing:
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			break probing
+		case <-deadline.C:
+			break probing
+		case <-ticker.C:
+		}
+		probes.Add(1)
+		go func(i int) {
+			defer probes.Done()
+			x := s.iteration(ctx, latency_url, certificates, nil, func() (*http.Request, error) {
+				return http.NewRequest("GET", latency_url.String(), nil)
+			}, nil)
+			x.Iteration = i
+			mu.Lock()
+			all = append(all, x)
+			mu.Unlock()
+		}(i)
+	}
+	probes.Wait()
+	stopLoad()
+	load.Wait()
+
+	// probes may return out of order
+	sort.Slice(all, func(i, j int) bool { return all[i].Iteration < all[j].Iteration })
+	l := newLoadedLatency(direction, all)
+	bytes, elapsed := w.total()
+	l.BitsPerSecond = bitsPerSecond(bytes, elapsed)
+	l.LoadSucceeded, l.LoadFailed = counter.succeeded, counter.failed
+	if err := ctx.Err(); err != nil {
+		return l, err
+	}
+	return l, counter.check()
+}
+
+func newLoadedLatency(direction string, all []Sample) *LoadedLatency {
+	l := &LoadedLatency{Direction: direction, Samples: all}
+	samples := successful(all)
+	l.Succeeded = len(samples)
+	l.Failed = len(all) - len(samples)
+	tcptimes := sampleDurations(samples, func(x Sample) time.Duration { return x.TCP })
+	if len(tcptimes) == 0 {
+		return l
+	}
+	l.Latency = averageDuration(samples, func(x Sample) time.Duration { return x.TCP })
+	l.Jitter = jitter(tcptimes)
+	seconds := make([]float64, 0, len(tcptimes))
+	for _, d := range tcptimes {
+		seconds = append(seconds, d.Seconds())
+	}
+	percentile := func(p float64) time.Duration {
+		v, _ := stats.Percentile(seconds, p)
+		return time.Duration(v * float64(time.Second))
+	}
+	l.Percentile50, l.Percentile90, l.Percentile99 = percentile(50), percentile(90), percentile(99)
+	return l
+}
+
+// bufferbloatGrades are the grades of BufferbloatGrade from best to worst.
+var bufferbloatGrades = []string{"A+", "A", "B", "C", "D", "F"}
+
+// BufferbloatGrade grades how much latency increases under load, using the
+// thresholds of the Waveform bufferbloat test: A+ below 5ms, A below 30ms,
+// B below 60ms, C below 200ms, D below 400ms and F above.
+func BufferbloatGrade(increase time.Duration) string {
+	switch {
+	case increase < 5*time.Millisecond:
+		return "A+"
+	case increase < 30*time.Millisecond:
+		return "A"
+	case increase < 60*time.Millisecond:
+		return "B"
+	case increase < 200*time.Millisecond:
+		return "C"
+	case increase < 400*time.Millisecond:
+		return "D"
+	default:
+		return "F"
+	}
+}
@@ -0,0 +1,112 @@
+package speedtest
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cfspeedtest/stats"
+)
+
+// Progress is the number of bytes a transfer had moved Elapsed after its first byte.
+type Progress struct {
+	Elapsed time.Duration
+	Bytes   int64
+}
+
+const (
+	// rampUpShare is the share of the median interval throughput that
+	// ends the ramp-up of a transfer.
+	rampUpShare = 0.8
+	// minSteadyIntervals is the number of intervals after ramp-up needed
+	// for a steady-state throughput.
+	minSteadyIntervals = 3
+)
+
+// progressRecorder samples a byte counter at a fixed interval.
+type progressRecorder struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	points  []Progress
+	stopped bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// start begins recording n every interval, unless the recorder is disabled,
+// already running or stopped.
+func (p *progressRecorder) start(n *atomic.Int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.interval <= 0 || p.stopped || p.stop != nil {
+		return
+	}
+	p.stop, p.done = make(chan struct{}), make(chan struct{})
+	p.points = append(p.points, Progress{})
+	start := time.Now()
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.add(Progress{Elapsed: time.Since(start), Bytes: n.Load()})
+			case <-p.stop:
+				p.add(Progress{Elapsed: time.Since(start), Bytes: n.Load()})
+				return
+			}
+		}
+	}()
+}
+
+func (p *progressRecorder) add(x Progress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.points = append(p.points, x)
+}
+
+// finish records the last point and waits for the recording to end.
+func (p *progressRecorder) finish() {
+	p.mu.Lock()
+	p.stopped = true
+	stop, done := p.stop, p.done
+	p.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// series returns the points recorded so far.
+func (p *progressRecorder) series() []Progress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Progress(nil), p.points...)
+}
+
+// steadyBitsPerSecond is the throughput of a transfer after its ramp-up,
+// which ends with the first interval that reaches rampUpShare of the median
+// interval throughput. It is 0 if fewer than minSteadyIntervals follow.
+func steadyBitsPerSecond(progress []Progress) float64 {
+	if len(progress) < 2 {
+		return 0
+	}
+	rates := make([]float64, 0, len(progress)-1)
+	for i := 1; i < len(progress); i++ {
+		rates = append(rates, bitsPerSecond(progress[i].Bytes-progress[i-1].Bytes, progress[i].Elapsed-progress[i-1].Elapsed))
+	}
+	median, _ := stats.Percentile(rates, 50)
+	for i, rate := range rates {
+		if rate < rampUpShare*median {
+			continue
+		}
+		if len(rates)-i < minSteadyIntervals {
+			return 0
+		}
+		from, to := progress[i], progress[len(progress)-1]
+		return bitsPerSecond(to.Bytes-from.Bytes, to.Elapsed-from.Elapsed)
+	}
+	return 0
+}
@@ -0,0 +1,245 @@
+package speedtest
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// labelNameRE matches valid Prometheus label names.
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabels are set by the writers themselves, target only by
+// WriteInflux, and cannot be supplied by the user.
+var reservedLabels = map[string]bool{"target": true, "family": true, "test": true, "result": true, "direction": true, "quantile": true, "grade": true, "protocol": true, "tls_version": true}
+
+// ValidateLabel checks that name can be used as a static Prometheus label.
+func ValidateLabel(name string) error {
+	if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("invalid label name %q: must match %s and not start with __", name, labelNameRE)
+	}
+	if reservedLabels[name] {
+		return fmt.Errorf("label name %q is reserved", name)
+	}
+	return nil
+}
+
+// WritePrometheus writes results in the Prometheus text exposition format,
+// using base units. labels are added to every sample.
+func WritePrometheus(w io.Writer, labels map[string]string, results ...*Result) error {
+	p, err := newPromWriter(labels)
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		p.addResult(r)
+	}
+	return p.write(w)
+}
+
+// promFamily is a metric with its HELP and TYPE metadata.
+type promFamily struct {
+	name, typ, help string
+	samples         []promSample
+}
+
+type promSample struct {
+	labels []string // alternating names and values
+	value  float64
+}
+
+// promWriter collects samples grouped by metric family, so that families
+// are written once even if they are added to from several results.
+type promWriter struct {
+	labels   []string
+	families []*promFamily
+	index    map[string]*promFamily
+}
+
+func newPromWriter(labels map[string]string) (*promWriter, error) {
+	p := &promWriter{index: map[string]*promFamily{}}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if err := ValidateLabel(name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p.labels = append(p.labels, name, labels[name])
+	}
+	return p, nil
+}
+
+// add records a sample; labels alternate between names and values.
+func (p *promWriter) add(name, typ, help string, value float64, labels ...string) {
+	f, ok := p.index[name]
+	if !ok {
+		f = &promFamily{name: name, typ: typ, help: help}
+		p.index[name] = f
+		p.families = append(p.families, f)
+	}
+	f.samples = append(f.samples, promSample{labels: labels, value: value})
+}
+
+// addResult records the metrics of a run, labelled with its address family.
+func (p *promWriter) addResult(r *Result) {
+	family := []string{"family", r.Family}
+	reachable := 1.0
+	if r.Unreachable != "" {
+		reachable = 0
+	}
+	p.add("cf_reachable", "gauge", "Whether the speedtest server could be reached over the address family.", reachable, family...)
+	p.add("cf_start_timestamp_seconds", "gauge", "Unix time the speedtest run started.", float64(r.Start.UnixNano())/1e9, family...)
+	if r.Unreachable != "" {
+		return
+	}
+	p.add("cf_run_duration_seconds", "gauge", "Duration of the speedtest run.", r.End.Sub(r.Start).Seconds(), family...)
+	p.add("cf_latency_seconds", "gauge", "Average tcp connection time of the idle latency probes.", r.Latency.Seconds(), family...)
+	p.add("cf_jitter_seconds", "gauge", "Corrected standard deviation of the idle latency probes.", r.Jitter.Seconds(), family...)
+	p.add("cf_dns_lookup_seconds", "gauge", "Average dns lookup time of the idle latency probes.", r.DNSTime.Seconds(), family...)
+	if r.RTT > 0 {
+		p.add("cf_rtt_seconds", "gauge", "Average server time of the idle latency probes, from connection to first response byte, minus the Server-Timing processing time.", r.RTT.Seconds(), family...)
+	}
+	p.addConnections("cf_", "the run", r.Connections, family...)
+
+	p.addTestResults("download", r.Family, r.Adaptive, r.Download)
+	p.add("cf_download_p90_bits_per_second", "gauge", "90th percentile of the download throughput of all iterations long enough to count.", r.DownloadPercentile90, family...)
+	p.add("cf_download_per_test_p90_bits_per_second", "gauge", "90th percentile of the per test download throughput.", r.DownloadPerTestPercentile90, family...)
+	p.addTestResults("upload", r.Family, r.Adaptive, r.Upload)
+	p.add("cf_upload_p90_bits_per_second", "gauge", "90th percentile of the upload throughput of all iterations long enough to count.", r.UploadPercentile90, family...)
+	p.add("cf_upload_per_test_p90_bits_per_second", "gauge", "90th percentile of the per test upload throughput.", r.UploadPerTestPercentile90, family...)
+
+	for _, l := range r.LoadedLatency {
+		direction := []string{"family", r.Family, "direction", l.Direction}
+		for _, c := range []struct {
+			result string
+			count  int
+		}{{"succeeded", l.Succeeded}, {"failed", l.Failed}} {
+			p.add("cf_loaded_latency_probes", "gauge", "Number of latency probes under load by result.", float64(c.count), append(direction, "result", c.result)...)
+		}
+		for _, c := range []struct {
+			result string
+			count  int
+		}{{"succeeded", l.LoadSucceeded}, {"failed", l.LoadFailed}} {
+			p.add("cf_loaded_load_transfers", "gauge", "Number of load transfers during the latency under load measurement by result.", float64(c.count), append(direction, "result", c.result)...)
+		}
+		p.add("cf_loaded_load_bits_per_second", "gauge", "Throughput of the load during the latency under load measurement.", l.BitsPerSecond, direction...)
+		if l.Succeeded == 0 {
+			continue
+		}
+		p.add("cf_loaded_latency_seconds", "gauge", "Average tcp connection time of the latency probes under load.", l.Latency.Seconds(), direction...)
+		for _, q := range []struct {
+			quantile string
+			value    float64
+		}{{"0.5", l.Percentile50.Seconds()}, {"0.9", l.Percentile90.Seconds()}, {"0.99", l.Percentile99.Seconds()}} {
+			p.add("cf_loaded_latency_percentile_seconds", "gauge", "Percentiles of the tcp connection time of the latency probes under load.", q.value, append(direction, "quantile", q.quantile)...)
+		}
+		p.add("cf_loaded_jitter_seconds", "gauge", "Corrected standard deviation of the latency probes under load.", l.Jitter.Seconds(), direction...)
+		if l.Grade != "" {
+			p.add("cf_loaded_latency_increase_seconds", "gauge", "Average latency under load minus the idle latency.", l.Increase.Seconds(), direction...)
+		}
+	}
+	if r.BufferbloatGrade != "" {
+		p.add("cf_bufferbloat_grade", "gauge", "Bufferbloat grade of the worse direction, always 1.", 1, "family", r.Family, "grade", r.BufferbloatGrade)
+	}
+}
+
+func (p *promWriter) addTestResults(direction, family string, adaptive bool, results []TestResult) {
+	for _, tr := range results {
+		test := []string{"family", family, "test", tr.Test.Name}
+		p.add("cf_"+direction+"_size_bytes", "gauge", "Size of a single "+direction+" transfer.", float64(tr.Test.NumBytes), test...)
+		for _, c := range []struct {
+			result string
+			count  int
+		}{{"succeeded", tr.Succeeded}, {"failed", tr.Failed}, {"timed_out", tr.TimedOut}} {
+			p.add("cf_"+direction+"_iterations", "gauge", "Number of "+direction+" iterations by result.", float64(c.count), append(test, "result", c.result)...)
+		}
+		if adaptive {
+			skipped := 0.0
+			if tr.Skipped {
+				skipped = 1
+			}
+			p.add("cf_"+direction+"_skipped", "gauge", "Whether the adaptive run skipped the "+direction+" test because its transfers were too short.", skipped, test...)
+		}
+		if tr.Succeeded == 0 {
+			continue
+		}
+		p.add("cf_"+direction+"_bits_per_second", "gauge", "Average "+direction+" throughput.", tr.BitsPerSecond, test...)
+		if tr.SteadyBitsPerSecond > 0 {
+			p.add("cf_"+direction+"_steady_bits_per_second", "gauge", "Average "+direction+" throughput after the ramp-up of each transfer.", tr.SteadyBitsPerSecond, test...)
+		}
+		p.add("cf_"+direction+"_latency_seconds", "gauge", "Average duration of a whole "+direction+" request.", tr.Latency.Seconds(), test...)
+		p.add("cf_"+direction+"_jitter_seconds", "gauge", "Corrected standard deviation of the "+direction+" tcp connection times.", tr.Jitter.Seconds(), test...)
+		if tr.RTT > 0 {
+			p.add("cf_"+direction+"_rtt_seconds", "gauge", "Average server time of the "+direction+" requests, from connection to first response byte, minus the Server-Timing processing time.", tr.RTT.Seconds(), test...)
+		}
+		p.addConnections("cf_"+direction+"_", "the "+direction+" test", tr.Connections, test...)
+		if tr.Test.Streams > 1 {
+			p.add("cf_"+direction+"_streams", "gauge", "Number of concurrent "+direction+" transfers per iteration.", float64(tr.Test.Streams), test...)
+			p.add("cf_"+direction+"_fairness_ratio", "gauge", "Jain's fairness index of the throughput of the concurrent "+direction+" transfers.", tr.Fairness, test...)
+		}
+	}
+}
+
+// addConnections records the protocol, tls version, connection reuse and
+// tls handshake percentiles of c under metrics starting with prefix.
+func (p *promWriter) addConnections(prefix, of string, c Connections, labels ...string) {
+	info := append(append([]string{}, labels...), "protocol", c.Protocol, "tls_version", c.TLSVersion)
+	p.add(prefix+"connection_info", "gauge", "Protocols and tls versions negotiated in "+of+", always 1.", 1, info...)
+	p.add(prefix+"reused_connections", "gauge", "Number of iterations of "+of+" sent on an existing connection.", float64(c.Reused), labels...)
+	if c.TLSVersion == "" {
+		return
+	}
+	for _, q := range []struct {
+		quantile string
+		value    float64
+	}{{"0.5", c.TLSHandshake50.Seconds()}, {"0.9", c.TLSHandshake90.Seconds()}, {"0.99", c.TLSHandshake99.Seconds()}} {
+		p.add(prefix+"tls_handshake_seconds", "gauge", "Percentiles of the tls handshake times of "+of+".", q.value, append(append([]string{}, labels...), "quantile", q.quantile)...)
+	}
+}
+
+func (p *promWriter) write(w io.Writer) error {
+	var b strings.Builder
+	for _, f := range p.families {
+		fmt.Fprintf(&b, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.typ)
+		for _, x := range f.samples {
+			b.WriteString(f.name)
+			labels := append(append([]string{}, p.labels...), x.labels...)
+			if len(labels) > 0 {
+				b.WriteByte('{')
+				for i := 0; i < len(labels); i += 2 {
+					if i > 0 {
+						b.WriteByte(',')
+					}
+					fmt.Fprintf(&b, "%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1]))
+				}
+				b.WriteByte('}')
+			}
+			b.WriteByte(' ')
+			b.WriteString(strconv.FormatFloat(x.value, 'g', -1, 64))
+			b.WriteByte('\n')
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+// escapeLabelValue turns s, e.g. a test name, into a valid label value.
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(strings.ToValidUTF8(strings.TrimSpace(s), "�"))
+}
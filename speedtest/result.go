@@ -0,0 +1,533 @@
+package speedtest
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"cfspeedtest/stats"
+	"cfspeedtest/timeCalculations"
+)
+
+// Phases a failed iteration can fail in.
+const (
+	PhaseRequest   = "request"   // building the request
+	PhaseDNS       = "dns"       // resolving the host
+	PhaseConnect   = "connect"   // establishing the tcp connection
+	PhaseTLS       = "tls"       // tls handshake
+	PhaseResponse  = "response"  // sending the request and waiting for the response
+	PhaseBody      = "body"      // reading the response body
+	PhaseIntegrity = "integrity" // the body was shorter or longer than requested
+	PhaseStatus    = "status"    // the server answered with an unexpected status
+)
+
+// Sample holds the phase timings of a single iteration of a test.
+// Failed iterations only have Iteration, Phase, Err and possibly Status set,
+// integrity failures also Bytes.
+type Sample struct {
+	Iteration int
+
+	DNS      time.Duration // dns lookup
+	Connect  time.Duration // tcp handshake
+	TCP      time.Duration // dns done until the connection is ready
+	TLS      time.Duration // tls handshake, included in TCP
+	Server   time.Duration // connection ready until the first response byte
+	TTFB     time.Duration // start of the request until the first response byte
+	Transfer time.Duration // body transfer
+	Full     time.Duration // whole request
+
+	// ServerTiming is the processing time the server reported in its
+	// Server-Timing header, zero without one. If it is reported, RTT is
+	// Server minus ServerTiming for requests without body, and Transfer of
+	// uploads excludes it. RawTransfer is the transfer as measured.
+	ServerTiming time.Duration
+	RTT          time.Duration
+	RawTransfer  time.Duration
+
+	Status int // http status code
+	// Proto is the protocol of the response, e.g. "HTTP/1.1" or "HTTP/2.0".
+	Proto string
+	// TLSVersion, CipherSuite and ALPN describe the tls connection, e.g.
+	// "TLS 1.3", "TLS_AES_128_GCM_SHA256" and "h2"; empty without tls.
+	TLSVersion, CipherSuite, ALPN string
+	// Reused is set if the request was sent on an existing connection,
+	// in which case DNS, Connect, TCP and TLS are zero. WasIdle and
+	// IdleTime tell whether and how long it was idle before.
+	Reused, WasIdle bool
+	IdleTime        time.Duration
+
+	Phase string
+	Err   error
+	// TimedOut is set if the iteration failed because a deadline passed.
+	TimedOut bool
+
+	// Streams holds the samples of the concurrent transfers of a
+	// multi-stream iteration, with Iteration set to the stream number.
+	// Transfer and RawTransfer are then the interval in which all streams
+	// were transferring, Bytes the bytes moved by all of them in it, and the
+	// other timings are the average over the streams, except Full, which is
+	// the longest.
+	Streams []Sample
+	// Bytes is the number of bytes counted during Transfer.
+	Bytes int64
+	// Progress holds the bytes counted every ProgressInterval from the
+	// first byte on, ending with the last. SteadyBitsPerSecond is the
+	// throughput after the ramp-up, zero if the transfer was too short to
+	// tell. Multi-stream iterations keep the progress in their streams and
+	// add up their steady throughput.
+	Progress            []Progress
+	SteadyBitsPerSecond float64
+	// Fairness is Jain's index of the throughput of the streams, from 1/n
+	// if one stream got all of it to 1 if all streams got the same. It is
+	// zero if no stream moved a byte.
+	Fairness float64
+}
+
+// OK reports whether the iteration succeeded.
+func (x Sample) OK() bool {
+	return x.Err == nil
+}
+
+// Connections summarizes the connections of successful iterations.
+type Connections struct {
+	// Protocol and TLSVersion list the distinct values seen, separated by
+	// commas, e.g. "HTTP/2.0" or "HTTP/2.0,HTTP/1.1". TLSVersion is empty
+	// without tls.
+	Protocol, TLSVersion string
+	// Reused counts the iterations that ran on an existing connection.
+	Reused int
+	// TLSHandshake50, TLSHandshake90 and TLSHandshake99 are percentiles of
+	// the tls handshakes, zero if there were none.
+	TLSHandshake50, TLSHandshake90, TLSHandshake99 time.Duration
+}
+
+func newConnections(samples []Sample) Connections {
+	var c Connections
+	var protocols, versions []string
+	var handshakes []float64
+	for _, x := range samples {
+		if !x.OK() {
+			continue
+		}
+		protocols = appendDistinct(protocols, x.Proto)
+		versions = appendDistinct(versions, x.TLSVersion)
+		if x.Reused {
+			c.Reused++
+		}
+		if x.TLS > 0 {
+			handshakes = append(handshakes, x.TLS.Seconds())
+		}
+	}
+	c.Protocol = strings.Join(protocols, ",")
+	c.TLSVersion = strings.Join(versions, ",")
+	if len(handshakes) > 0 {
+		percentile := func(p float64) time.Duration {
+			v, _ := stats.Percentile(handshakes, p)
+			return time.Duration(v * float64(time.Second))
+		}
+		c.TLSHandshake50, c.TLSHandshake90, c.TLSHandshake99 = percentile(50), percentile(90), percentile(99)
+	}
+	return c
+}
+
+// appendDistinct appends v to list unless it is empty or already in it.
+func appendDistinct(list []string, v string) []string {
+	for _, have := range list {
+		if have == v {
+			return list
+		}
+	}
+	if v == "" {
+		return list
+	}
+	return append(list, v)
+}
+
+// TestResult summarizes the iterations of one Test.
+// Only successful iterations are included in the throughput and timings.
+type TestResult struct {
+	Test          Test
+	BitsPerSecond float64
+	// Latency is the average duration of a whole request.
+	Latency time.Duration
+	// RTT is the average network round trip of the downloads, zero unless
+	// the server sent Server-Timing.
+	RTT time.Duration
+	// SteadyBitsPerSecond is the average throughput after ramp-up of the
+	// iterations long enough to have one, zero if none was.
+	SteadyBitsPerSecond float64
+	// Jitter is the corrected standard deviation of the tcp connection times.
+	Jitter  time.Duration
+	Samples []Sample
+	// Fairness is the average fairness of the multi-stream iterations.
+	Fairness    float64
+	Connections Connections
+
+	Succeeded, Failed int
+	// TimedOut counts the failed iterations that hit a deadline.
+	TimedOut int
+	// Skipped is set by adaptive runs if the transfers were too short to
+	// measure; the test is then left out of the percentiles.
+	Skipped bool
+}
+
+// Result holds everything measured by RunAllTests.
+type Result struct {
+	Start, End time.Time
+
+	// Target is the base url of the speedtest server.
+	Target string
+	// Family is the address family the run used.
+	Family string
+	// Unreachable is set to the reason if the server could not be reached
+	// over Family, in which case no tests were run.
+	Unreachable string
+	// LatencyReps, DownloadTests and UploadTests are the configured test plan.
+	LatencyReps                int
+	DownloadTests, UploadTests []Test
+	// Adaptive is set if the tests were sized adaptively, in which case
+	// Download and Upload only hold the tests that were tried.
+	Adaptive bool
+
+	// Latency, Jitter and DNSTime are measured with empty downloads.
+	Latency, Jitter, DNSTime time.Duration
+	// RTT is the average Server time of the latency probes minus the
+	// server processing time, zero unless the server sent Server-Timing.
+	RTT            time.Duration
+	LatencySamples []Sample
+	// Connections summarizes the connections of every iteration of the
+	// run, including the latency probes.
+	Connections Connections
+
+	Download, Upload []TestResult
+
+	// LoadedLatency holds the latency under download and upload load, if
+	// it was measured. BufferbloatGrade is the worse grade of the two.
+	LoadedLatency    []LoadedLatency
+	BufferbloatGrade string
+
+	// DownloadPercentile90 and UploadPercentile90 are the aggregate
+	// bandwidth the way speed.cloudflare.com computes it: the 90th
+	// percentile of the throughput of every successful iteration whose
+	// transfer lasted at least BandwidthMinDuration, in bits per second.
+	DownloadPercentile90, UploadPercentile90 float64
+	BandwidthMinDuration                     time.Duration
+	// DownloadPerTestPercentile90 and UploadPerTestPercentile90 are the
+	// 90th percentile of the per test throughput, the aggregate of earlier
+	// versions.
+	DownloadPerTestPercentile90, UploadPerTestPercentile90 float64
+}
+
+func newTestResult(test Test, all []Sample) TestResult {
+	tr := TestResult{Test: test, Samples: all, Connections: newConnections(all)}
+	samples := successful(all)
+	tr.Succeeded = len(samples)
+	tr.Failed = len(all) - len(samples)
+	for _, x := range all {
+		if x.TimedOut {
+			tr.TimedOut++
+		}
+	}
+	if len(samples) == 0 {
+		return tr
+	}
+	fulltimes := sampleDurations(samples, func(x Sample) time.Duration { return x.Full })
+	tcptimes := sampleDurations(samples, func(x Sample) time.Duration { return x.TCP })
+	transfertimes := sampleDurations(samples, func(x Sample) time.Duration { return x.Transfer })
+
+	// throughput of the bytes counted during the transfers; multi-stream
+	// transfers only count the intervals in which all streams were transferring
+	var bytes int64
+	var fairness float64
+	var fair int
+	for _, x := range samples {
+		bytes += x.Bytes
+		if x.Fairness > 0 {
+			fairness += x.Fairness
+			fair++
+		}
+	}
+	if avg_transfer := timeCalculations.CalculateAverageDurationSeconds(transfertimes); avg_transfer > 0 {
+		tr.BitsPerSecond = float64(bytes*8) / float64(len(samples)) / avg_transfer
+	}
+	if fair > 0 {
+		tr.Fairness = fairness / float64(fair)
+	}
+	tr.Latency = time.Duration(timeCalculations.CalculateAverageDuration(fulltimes))
+	tr.RTT = averageRTT(samples)
+	var steady []float64
+	for _, x := range samples {
+		if x.SteadyBitsPerSecond > 0 {
+			steady = append(steady, x.SteadyBitsPerSecond)
+		}
+	}
+	if len(steady) > 0 {
+		tr.SteadyBitsPerSecond, _ = stats.Mean(steady)
+	}
+	tr.Jitter = jitter(tcptimes)
+	return tr
+}
+
+// finish records the end of the run and computes the aggregates, counting
+// transfers of at least minDuration towards the bandwidth.
+func (r *Result) finish(minDuration time.Duration) {
+	r.End = time.Now()
+	all := append([]Sample{}, r.LatencySamples...)
+	for _, tr := range append(append([]TestResult{}, r.Download...), r.Upload...) {
+		all = append(all, tr.Samples...)
+	}
+	for _, l := range r.LoadedLatency {
+		all = append(all, l.Samples...)
+	}
+	r.Connections = newConnections(all)
+	r.BandwidthMinDuration = minDuration
+	r.DownloadPercentile90 = bandwidth(r.Download, minDuration)
+	r.UploadPercentile90 = bandwidth(r.Upload, minDuration)
+	r.DownloadPerTestPercentile90 = perTestPercentile90(r.Download)
+	r.UploadPerTestPercentile90 = perTestPercentile90(r.Upload)
+}
+
+// bandwidth is the 90th percentile of the throughput of the successful
+// iterations of all tests whose transfer lasted at least minDuration.
+func bandwidth(results []TestResult, minDuration time.Duration) float64 {
+	var speeds []float64
+	for _, tr := range results {
+		for _, x := range tr.Samples {
+			if x.OK() && x.Transfer > 0 && x.Transfer >= minDuration {
+				speeds = append(speeds, bitsPerSecond(x.Bytes, x.Transfer))
+			}
+		}
+	}
+	p, _ := stats.Percentile(speeds, 90.0)
+	return p
+}
+
+// perTestPercentile90 is the 90th percentile of the throughput of the tests
+// that had successful iterations and were not skipped.
+func perTestPercentile90(results []TestResult) float64 {
+	speeds := make([]float64, 0, len(results))
+	for _, tr := range results {
+		if tr.Succeeded > 0 && !tr.Skipped {
+			speeds = append(speeds, tr.BitsPerSecond)
+		}
+	}
+	p, _ := stats.Percentile(speeds, 90.0)
+	return p
+}
+
+// setLatency summarizes the latency probes.
+func (r *Result) setLatency(all []Sample) {
+	r.LatencySamples = all
+	samples := successful(all)
+	tcptimes := sampleDurations(samples, func(x Sample) time.Duration { return x.TCP })
+	dnstimes := sampleDurations(samples, func(x Sample) time.Duration { return x.DNS })
+	r.Latency = time.Duration(timeCalculations.CalculateAverageDuration(tcptimes))
+	r.Jitter = jitter(tcptimes)
+	r.DNSTime = time.Duration(timeCalculations.CalculateAverageDuration(dnstimes))
+	r.RTT = averageRTT(samples)
+}
+
+// averageRTT is the average RTT of the samples that have one.
+func averageRTT(samples []Sample) time.Duration {
+	var rtts []time.Duration
+	for _, x := range samples {
+		if x.RTT > 0 {
+			rtts = append(rtts, x.RTT)
+		}
+	}
+	if len(rtts) == 0 {
+		return 0
+	}
+	return time.Duration(timeCalculations.CalculateAverageDuration(rtts))
+}
+
+// addLoadedLatency grades l against the idle latency and adds it to the run.
+// Without probes or without load there is nothing to grade.
+func (r *Result) addLoadedLatency(l LoadedLatency) {
+	if l.Succeeded > 0 && l.LoadSucceeded > 0 {
+		l.Increase = l.Latency - r.Latency
+		l.Grade = BufferbloatGrade(l.Increase)
+		if gradeIndex(l.Grade) > gradeIndex(r.BufferbloatGrade) {
+			r.BufferbloatGrade = l.Grade
+		}
+	}
+	r.LoadedLatency = append(r.LoadedLatency, l)
+}
+
+// gradeIndex orders bufferbloat grades from best to worst; no grade is -1.
+func gradeIndex(grade string) int {
+	for i, g := range bufferbloatGrades {
+		if g == grade {
+			return i
+		}
+	}
+	return -1
+}
+
+// successful filters out failed iterations.
+func successful(samples []Sample) []Sample {
+	ok := make([]Sample, 0, len(samples))
+	for _, x := range samples {
+		if x.OK() {
+			ok = append(ok, x)
+		}
+	}
+	return ok
+}
+
+// sampleDurations picks one duration out of every sample.
+func sampleDurations(samples []Sample, pick func(Sample) time.Duration) []time.Duration {
+	durations := make([]time.Duration, 0, len(samples))
+	for _, x := range samples {
+		durations = append(durations, pick(x))
+	}
+	return durations
+}
+
+// jitter is the corrected standard deviation of values, or 0 if it is undefined.
+func jitter(values []time.Duration) time.Duration {
+	if len(values) < 2 {
+		return 0
+	}
+	return time.Duration(timeCalculations.CalculateCorrectedDeviation(values))
+}
+
+// ms converts d to fractional milliseconds.
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Print writes r as cf_* lines, one metric per line.
+func (r *Result) Print(w io.Writer) error {
+	var err error
+	printf := func(format string, a ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, a...)
+		}
+	}
+
+	printf("cf_start_timestamp %v\n", r.Start.Unix())
+	printf("cf_address_family %s\n", r.Family)
+	if r.Unreachable != "" {
+		printf("cf_unreachable 1\n")
+		return err
+	}
+	printf("cf_latency_ms %.2f\n", ms(r.Latency))
+	printf("cf_tcp_jitter_ms %.2f\n", ms(r.Jitter))
+	printf("cf_dnslookup_ms %.2f\n", ms(r.DNSTime))
+	if r.RTT > 0 {
+		printf("cf_rtt_ms %.2f\n", ms(r.RTT))
+	}
+	printConnections := func(prefix string, c Connections) {
+		printf("%sprotocol %s\n", prefix, c.Protocol)
+		printf("%sreused_connections %d\n", prefix, c.Reused)
+		if c.TLSVersion == "" {
+			return
+		}
+		printf("%stls_version %s\n", prefix, c.TLSVersion)
+		printf("%stls_handshake_p50_ms %.2f\n", prefix, ms(c.TLSHandshake50))
+		printf("%stls_handshake_p90_ms %.2f\n", prefix, ms(c.TLSHandshake90))
+		printf("%stls_handshake_p99_ms %.2f\n", prefix, ms(c.TLSHandshake99))
+	}
+	printConnections("cf_", r.Connections)
+
+	for _, tr := range r.Download {
+		printf("cf_%v_download_latency_ms %.2f\n", tr.Test.Name, ms(tr.Latency))
+		if tr.RTT > 0 {
+			printf("cf_%v_download_rtt_ms %.2f\n", tr.Test.Name, ms(tr.RTT))
+		}
+		printf("cf_%v_download_Mbps %.2f\n", tr.Test.Name, tr.BitsPerSecond/1e6)
+		if tr.SteadyBitsPerSecond > 0 {
+			printf("cf_%v_download_steady_Mbps %.2f\n", tr.Test.Name, tr.SteadyBitsPerSecond/1e6)
+		}
+		printf("cf_%v_download_tcp_jitter %.2f\n", tr.Test.Name, ms(tr.Jitter))
+		printf("cf_%v_download_succeeded %d\n", tr.Test.Name, tr.Succeeded)
+		printf("cf_%v_download_failed %d\n", tr.Test.Name, tr.Failed)
+		printf("cf_%v_download_timed_out %d\n", tr.Test.Name, tr.TimedOut)
+		if tr.Skipped {
+			printf("cf_%v_download_skipped 1\n", tr.Test.Name)
+		}
+		printConnections(fmt.Sprintf("cf_%v_download_", tr.Test.Name), tr.Connections)
+		if tr.Test.Streams > 1 {
+			printf("cf_%v_download_streams %d\n", tr.Test.Name, tr.Test.Streams)
+			printf("cf_%v_download_fairness %.3f\n", tr.Test.Name, tr.Fairness)
+		}
+	}
+	printf("cf_90th_percentile_download_speed %.2f\n", r.DownloadPercentile90/1e6)
+	printf("cf_90th_percentile_per_test_download_speed %.2f\n", r.DownloadPerTestPercentile90/1e6)
+
+	for _, tr := range r.Upload {
+		printf("cf_%v_upload_latency_ms %.2f\n", tr.Test.Name, ms(tr.Latency))
+		printf("cf_%v_upload_Mbps %.2f\n", tr.Test.Name, tr.BitsPerSecond/1e6)
+		if tr.SteadyBitsPerSecond > 0 {
+			printf("cf_%v_upload_steady_Mbps %.2f\n", tr.Test.Name, tr.SteadyBitsPerSecond/1e6)
+		}
+		printf("cf_%v_upload_tcp_jitter %.2f\n", tr.Test.Name, ms(tr.Jitter))
+		printf("cf_%v_upload_succeeded %d\n", tr.Test.Name, tr.Succeeded)
+		printf("cf_%v_upload_failed %d\n", tr.Test.Name, tr.Failed)
+		printf("cf_%v_upload_timed_out %d\n", tr.Test.Name, tr.TimedOut)
+		if tr.Skipped {
+			printf("cf_%v_upload_skipped 1\n", tr.Test.Name)
+		}
+		printConnections(fmt.Sprintf("cf_%v_upload_", tr.Test.Name), tr.Connections)
+		if tr.Test.Streams > 1 {
+			printf("cf_%v_upload_streams %d\n", tr.Test.Name, tr.Test.Streams)
+			printf("cf_%v_upload_fairness %.3f\n", tr.Test.Name, tr.Fairness)
+		}
+	}
+	printf("cf_90th_percentile_upload_speed %.2f\n", r.UploadPercentile90/1e6)
+	printf("cf_90th_percentile_per_test_upload_speed %.2f\n", r.UploadPerTestPercentile90/1e6)
+
+	for _, l := range r.LoadedLatency {
+		printf("cf_loaded_%v_latency_ms %.2f\n", l.Direction, ms(l.Latency))
+		printf("cf_loaded_%v_p50_latency_ms %.2f\n", l.Direction, ms(l.Percentile50))
+		printf("cf_loaded_%v_p90_latency_ms %.2f\n", l.Direction, ms(l.Percentile90))
+		printf("cf_loaded_%v_p99_latency_ms %.2f\n", l.Direction, ms(l.Percentile99))
+		printf("cf_loaded_%v_tcp_jitter_ms %.2f\n", l.Direction, ms(l.Jitter))
+		printf("cf_loaded_%v_latency_increase_ms %.2f\n", l.Direction, ms(l.Increase))
+		printf("cf_loaded_%v_load_Mbps %.2f\n", l.Direction, l.BitsPerSecond/1e6)
+		printf("cf_loaded_%v_succeeded %d\n", l.Direction, l.Succeeded)
+		printf("cf_loaded_%v_failed %d\n", l.Direction, l.Failed)
+		printf("cf_loaded_%v_load_succeeded %d\n", l.Direction, l.LoadSucceeded)
+		printf("cf_loaded_%v_load_failed %d\n", l.Direction, l.LoadFailed)
+	}
+	if r.BufferbloatGrade != "" {
+		printf("cf_bufferbloat_grade %s\n", r.BufferbloatGrade)
+	}
+	return err
+}
+
+// PrintFailures writes one line per failed iteration.
+func (r *Result) PrintFailures(w io.Writer) {
+	if r.Unreachable != "" {
+		fmt.Fprintf(w, "%s: server unreachable: %s\n", r.Family, r.Unreachable)
+		return
+	}
+	for _, x := range r.LatencySamples {
+		if !x.OK() {
+			fmt.Fprintf(w, "%s: latency iteration %d failed during %s: %v\n", r.Family, x.Iteration, x.Phase, x.Err)
+		}
+	}
+	for _, tr := range r.Download {
+		for _, x := range tr.Samples {
+			if !x.OK() {
+				fmt.Fprintf(w, "%s: %s download iteration %d failed during %s: %v\n", r.Family, tr.Test.Name, x.Iteration, x.Phase, x.Err)
+			}
+		}
+	}
+	for _, tr := range r.Upload {
+		for _, x := range tr.Samples {
+			if !x.OK() {
+				fmt.Fprintf(w, "%s: %s upload iteration %d failed during %s: %v\n", r.Family, tr.Test.Name, x.Iteration, x.Phase, x.Err)
+			}
+		}
+	}
+	for _, l := range r.LoadedLatency {
+		for _, x := range l.Samples {
+			if !x.OK() {
+				fmt.Fprintf(w, "%s: latency probe %d under %s load failed during %s: %v\n", r.Family, x.Iteration, l.Direction, x.Phase, x.Err)
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package speedtest
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBandwidth(t *testing.T) {
+	failed := errors.New("failed")
+	results := []TestResult{
+		{Samples: []Sample{
+			{Bytes: 1000, Transfer: time.Second},
+			// too short to count
+			{Bytes: 1000, Transfer: 5 * time.Millisecond},
+			{Bytes: 1000},
+		}},
+		{Samples: []Sample{
+			{Bytes: 1000, Transfer: 10 * time.Millisecond, Err: failed},
+		}},
+	}
+	if got := bandwidth(results, 10*time.Millisecond); got != 8000 {
+		t.Errorf("bandwidth = %v, want 8000 from the one qualifying iteration", got)
+	}
+	if got := bandwidth(results, 0); got <= 8000 {
+		t.Errorf("bandwidth without a minimum = %v, want the short iteration counted", got)
+	}
+	if got := bandwidth(results, 2*time.Second); !math.IsNaN(got) {
+		t.Errorf("bandwidth without qualifying iterations = %v, want NaN", got)
+	}
+
+	// ten iterations of 1 to 10 kbit/s, the 90th percentile is the ninth
+	var tr TestResult
+	for i := 1; i <= 10; i++ {
+		tr.Samples = append(tr.Samples, Sample{Bytes: int64(125 * i), Transfer: time.Second})
+	}
+	if got := bandwidth([]TestResult{tr}, 10*time.Millisecond); got != 9000 {
+		t.Errorf("bandwidth = %v, want 9000", got)
+	}
+}
+
+func TestPerTestPercentile90(t *testing.T) {
+	results := []TestResult{
+		{Succeeded: 1, BitsPerSecond: 100},
+		{Succeeded: 0, Failed: 3},
+		{Succeeded: 2, BitsPerSecond: 1e9, Skipped: true},
+	}
+	if got := perTestPercentile90(results); got != 100 {
+		t.Errorf("perTestPercentile90 = %v, want 100 from the only test that counts", got)
+	}
+	if got := perTestPercentile90(results[1:]); !math.IsNaN(got) {
+		t.Errorf("perTestPercentile90 without tests that count = %v, want NaN", got)
+	}
+}
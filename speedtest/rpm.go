@@ -0,0 +1,498 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"cfspeedtest/stats"
+)
+
+// RPMConfigPath is the responsiveness config endpoint of the built-in server.
+const RPMConfigPath = "/.well-known/nq"
+
+// RPMConfig is the config document of a responsiveness server, as served by
+// networkQuality servers and by Server on RPMConfigPath.
+type RPMConfig struct {
+	Version int     `json:"version"`
+	URLs    RPMURLs `json:"urls"`
+}
+
+// RPMURLs are the endpoints used by the responsiveness test.
+type RPMURLs struct {
+	// SmallDownloadURL is fetched by the latency probes.
+	SmallDownloadURL string `json:"small_https_download_url"`
+	// LargeDownloadURL and UploadURL generate the load.
+	LargeDownloadURL string `json:"large_https_download_url"`
+	UploadURL        string `json:"https_upload_url"`
+}
+
+// RPMOptions configures Responsiveness. Zero values select the defaults of
+// the IETF draft.
+type RPMOptions struct {
+	// MaxDuration bounds each direction, 20s by default.
+	MaxDuration time.Duration
+	// Interval is the length of an interval in which throughput and
+	// responsiveness are sampled and a connection may be added, 1s by default.
+	Interval time.Duration
+	// ProbeInterval is the time between two rounds of probes, 100ms by default.
+	ProbeInterval time.Duration
+	// MaxConnections caps the load-generating connections, 16 by default.
+	MaxConnections int
+}
+
+const (
+	// rpmMAD is the number of intervals of the moving averages.
+	rpmMAD = 4
+	// rpmStability is the largest relative standard deviation of the
+	// moving averages that still counts as stable.
+	rpmStability = 0.05
+	// rpmTrim is the percentage of probes kept by the trimmed means.
+	rpmTrim = 95
+)
+
+func (o *RPMOptions) setDefaults() {
+	if o.MaxDuration <= 0 {
+		o.MaxDuration = 20 * time.Second
+	}
+	if o.Interval <= 0 {
+		o.Interval = time.Second
+	}
+	if o.ProbeInterval <= 0 {
+		o.ProbeInterval = 100 * time.Millisecond
+	}
+	if o.MaxConnections <= 0 {
+		o.MaxConnections = 16
+	}
+}
+
+// RPMResult holds the responsiveness under download and upload load.
+type RPMResult struct {
+	Start, End time.Time
+	// ConfigURL is the config endpoint the urls were taken from.
+	ConfigURL        string
+	Download, Upload Responsiveness
+}
+
+// Responsiveness is the outcome of the responsiveness test in one direction.
+type Responsiveness struct {
+	// Direction is "download" or "upload".
+	Direction string
+	// RPM is the number of round-trips per minute of the weighted mean of
+	// the foreign and self probes; ForeignRPM and SelfRPM count only one kind.
+	RPM, ForeignRPM, SelfRPM float64
+	// TCP, TLS and HTTP are the trimmed means of the phases of the foreign
+	// probes, which open a new connection. Self is the trimmed mean of the
+	// self probes, which are sent on the load-generating connections.
+	TCP, TLS, HTTP, Self time.Duration
+	// BitsPerSecond is the moving average of the load throughput.
+	BitsPerSecond float64
+	// Connections is the number of load-generating connections at the end.
+	Connections int
+	// LoadSucceeded and LoadFailed count the transfers on the load-generating
+	// connections; LoadError is the error of the last failed one.
+	LoadSucceeded, LoadFailed int
+	LoadError                 string
+	// Saturated is set if throughput and responsiveness were stable before
+	// MaxDuration passed.
+	Saturated bool
+	Duration  time.Duration
+
+	ForeignProbes, SelfProbes []Sample
+	// SelfReused counts the self probes sent on an existing connection of
+	// a load-generating transport. Only over HTTP/2 is that the busy load
+	// connection itself; over HTTP/1.1 it is an idle connection kept by the
+	// transport next to it.
+	SelfReused int
+}
+
+// FetchRPMConfig reads the config document at configURL.
+func (s *Speedtest) FetchRPMConfig(ctx context.Context, configURL string) (*RPMConfig, error) {
+	u, err := normalizeURL(configURL)
+	if err != nil {
+		return nil, err
+	}
+	certificates, err := readClientCert(s.ClientCertFile)
+	if err != nil {
+		return nil, err
+	}
+	req, err := newRequest(http.MethodGet, u, "", s.Headers)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	client, t := s.newClient(u, req.Host, certificates)
+	defer t.CloseIdleConnections()
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status %s", u, resp.Status)
+	}
+	cfg := &RPMConfig{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: invalid config: %v", u, err)
+	}
+	for _, v := range []struct{ name, url string }{
+		{"small_https_download_url", cfg.URLs.SmallDownloadURL},
+		{"large_https_download_url", cfg.URLs.LargeDownloadURL},
+		{"https_upload_url", cfg.URLs.UploadURL},
+	} {
+		if _, err := normalizeURL(v.url); err != nil {
+			return nil, fmt.Errorf("%s: invalid config: %s: %v", u, v.name, err)
+		}
+	}
+	return cfg, nil
+}
+
+// Responsiveness runs the "Responsiveness under Working Conditions" test of
+// the IETF IPPM working group, the methodology of networkQuality: load-
+// generating connections are added every interval until the throughput
+// saturates, while foreign probes on new connections and self probes on the
+// load-generating connections measure the round-trip time. The download
+// and upload directions are measured one after the other. A direction fails
+// if none of its load transfers succeeded.
+func (s *Speedtest) Responsiveness(ctx context.Context, configURL string, o RPMOptions) (*RPMResult, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	o.setDefaults()
+	cfg, err := s.FetchRPMConfig(ctx, configURL)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &RPMResult{Start: time.Now(), ConfigURL: configURL}
+	defer func() { r.End = time.Now() }()
+	if r.Download, err = s.responsiveness(ctx, "download", cfg.URLs, o); err != nil {
+		return r, fmt.Errorf("download: %v", err)
+	}
+	if r.Upload, err = s.responsiveness(ctx, "upload", cfg.URLs, o); err != nil {
+		return r, fmt.Errorf("upload: %v", err)
+	}
+	return r, nil
+}
+
+// rpmProbe is a probe together with the interval it was sent in.
+type rpmProbe struct {
+	interval int
+	foreign  bool
+	x        Sample
+}
+
+// responsiveness measures a single direction.
+func (s *Speedtest) responsiveness(ctx context.Context, direction string, urls RPMURLs, o RPMOptions) (Responsiveness, error) {
+	res := Responsiveness{Direction: direction}
+	certificates, err := readClientCert(s.ClientCertFile)
+	if err != nil {
+		return res, err
+	}
+	probe_url, err := normalizeURL(urls.SmallDownloadURL)
+	if err != nil {
+		return res, err
+	}
+	var load_url *url.URL
+	var newLoadReq func() (*http.Request, error)
+	switch direction {
+	case "download":
+		load_url, err = normalizeURL(urls.LargeDownloadURL)
+		newLoadReq = func() (*http.Request, error) { return http.NewRequest("GET", load_url.String(), nil) }
+	case "upload":
+		load_url, err = normalizeURL(urls.UploadURL)
+		newLoadReq = func() (*http.Request, error) {
+			// an endless body, the upload only ends with the test
+			return http.NewRequest("POST", load_url.String(), io.NopCloser(zeroReader{}))
+		}
+	}
+	if err != nil {
+		return res, err
+	}
+	newProbeReq := func() (*http.Request, error) { return http.NewRequest("GET", probe_url.String(), nil) }
+
+	start := time.Now()
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, o.MaxDuration)
+	defer cancel()
+	loadCtx, stopLoad := context.WithCancel(ctx)
+	defer stopLoad()
+
+	// every load-generating connection has a transport of its own, so
+	// that self probes share the connection instead of opening another
+	w := &streamWindow{}
+	var counter loadCounter
+	var (
+		load       sync.WaitGroup
+		clients    []*http.Client
+		transports []*http.Transport
+	)
+	defer func() {
+		for _, t := range transports {
+			t.CloseIdleConnections()
+		}
+	}()
+	addConnection := func() {
+		client, t := s.newClient(load_url, load_url.Host, certificates)
+		clients = append(clients, client)
+		transports = append(transports, t)
+		load.Add(1)
+		go func() {
+			defer load.Done()
+			s.generateLoad(loadCtx, load_url, certificates, client, newLoadReq, w, &counter)
+		}()
+	}
+	addConnection()
+
+	var (
+		mu       sync.Mutex
+		interval int
+		probes   []rpmProbe
+		inFlight sync.WaitGroup
+	)
+	sendProbe := func(client *http.Client, foreign bool) {
+		mu.Lock()
+		p := rpmProbe{interval: interval, foreign: foreign}
+		mu.Unlock()
+		inFlight.Add(1)
+		go func() {
+			defer inFlight.Done()
+			p.x = s.iteration(ctx, probe_url, certificates, client, newProbeReq, nil)
+			mu.Lock()
+			probes = append(probes, p)
+			mu.Unlock()
+		}()
+	}
+
+	intervals := time.NewTicker(o.Interval)
+	defer intervals.Stop()
+	probeTicker := time.NewTicker(o.ProbeInterval)
+	defer probeTicker.Stop()
+
+	var goodput, goodputMA, rpm, rpmMA []float64
+	var lastBytes int64
+	goodputStable := false
+	next := 0
+measuring:
+	for {
+		select {
+		case <-ctx.Done():
+			break measuring
+		case <-probeTicker.C:
+			sendProbe(nil, true)
+			sendProbe(clients[next%len(clients)], false)
+			next++
+		case <-intervals.C:
+			bytes := w.bytes.Load()
+			goodput = append(goodput, bitsPerSecond(bytes-lastBytes, o.Interval))
+			lastBytes = bytes
+			goodputMA = append(goodputMA, movingAverage(goodput))
+
+			mu.Lock()
+			var current []rpmProbe
+			for _, p := range probes {
+				if p.interval == interval {
+					current = append(current, p)
+				}
+			}
+			interval++
+			mu.Unlock()
+			if v := summarizeProbes(current).RPM; v > 0 {
+				rpm = append(rpm, v)
+				rpmMA = append(rpmMA, movingAverage(rpm))
+			}
+
+			if !goodputStable {
+				goodputStable = stable(goodputMA)
+			}
+			if goodputStable && stable(rpmMA) {
+				res.Saturated = true
+				break measuring
+			}
+			if !goodputStable && len(clients) < o.MaxConnections {
+				addConnection()
+			}
+		}
+	}
+	inFlight.Wait()
+	stopLoad()
+	load.Wait()
+	res.Duration = time.Since(start)
+	res.Connections = len(clients)
+	res.LoadSucceeded, res.LoadFailed = counter.succeeded, counter.failed
+	if counter.err != nil {
+		res.LoadError = counter.err.Error()
+	}
+	if err := parent.Err(); err != nil {
+		return res, err
+	}
+	if err := counter.check(); err != nil {
+		return res, err
+	}
+
+	// the result is computed over the last intervals, or everything if
+	// the test never got that far
+	first := interval - rpmMAD
+	var window []rpmProbe
+	for _, p := range probes {
+		if p.interval >= first {
+			window = append(window, p)
+		}
+	}
+	summary := summarizeProbes(window)
+	summary.Direction = direction
+	summary.Saturated = res.Saturated
+	summary.Duration = res.Duration
+	summary.Connections = res.Connections
+	summary.LoadSucceeded, summary.LoadFailed, summary.LoadError = res.LoadSucceeded, res.LoadFailed, res.LoadError
+	if len(goodputMA) > 0 {
+		summary.BitsPerSecond = goodputMA[len(goodputMA)-1]
+	}
+	return summary, nil
+}
+
+// summarizeProbes computes the trimmed means and round-trips per minute of probes.
+func summarizeProbes(probes []rpmProbe) Responsiveness {
+	var res Responsiveness
+	var tcp, tls, get, self []float64
+	for _, p := range probes {
+		if p.foreign {
+			res.ForeignProbes = append(res.ForeignProbes, p.x)
+		} else {
+			res.SelfProbes = append(res.SelfProbes, p.x)
+		}
+		if !p.x.OK() {
+			continue
+		}
+		roundTrip := (p.x.Server + p.x.Transfer).Seconds()
+		if !p.foreign {
+			self = append(self, roundTrip)
+			if p.x.Reused {
+				res.SelfReused++
+			}
+			continue
+		}
+		tcp = append(tcp, (p.x.TCP - p.x.TLS).Seconds())
+		if p.x.TLS > 0 {
+			tls = append(tls, p.x.TLS.Seconds())
+		}
+		get = append(get, roundTrip)
+	}
+
+	trimmed := func(values []float64) time.Duration {
+		m, err := stats.TrimmedMean(values, rpmTrim)
+		if err != nil {
+			return 0
+		}
+		return time.Duration(m * float64(time.Second))
+	}
+	res.TCP, res.TLS, res.HTTP, res.Self = trimmed(tcp), trimmed(tls), trimmed(get), trimmed(self)
+
+	// every foreign phase weighs the same, foreign and self probes half each
+	var foreign []time.Duration
+	if len(tcp) > 0 {
+		foreign = append(foreign, res.TCP, res.HTTP)
+		if len(tls) > 0 {
+			foreign = append(foreign, res.TLS)
+		}
+	}
+	var foreignMean time.Duration
+	for _, d := range foreign {
+		foreignMean += d / time.Duration(len(foreign))
+	}
+	res.ForeignRPM = roundTripsPerMinute(foreignMean)
+	res.SelfRPM = roundTripsPerMinute(res.Self)
+	switch {
+	case foreignMean > 0 && res.Self > 0:
+		res.RPM = roundTripsPerMinute((foreignMean + res.Self) / 2)
+	case foreignMean > 0:
+		res.RPM = res.ForeignRPM
+	default:
+		res.RPM = res.SelfRPM
+	}
+	return res
+}
+
+// roundTripsPerMinute converts a round-trip time, 0 if it is unknown.
+func roundTripsPerMinute(d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(time.Minute) / float64(d)
+}
+
+// movingAverage is the mean of the last rpmMAD values.
+func movingAverage(values []float64) float64 {
+	if len(values) > rpmMAD {
+		values = values[len(values)-rpmMAD:]
+	}
+	m, _ := stats.Mean(values)
+	return m
+}
+
+// stable reports whether the last rpmMAD moving averages deviate by less
+// than rpmStability from their mean.
+func stable(averages []float64) bool {
+	if len(averages) < rpmMAD {
+		return false
+	}
+	last := averages[len(averages)-rpmMAD:]
+	mean, _ := stats.Mean(last)
+	if mean <= 0 {
+		return false
+	}
+	var squares float64
+	for _, v := range last {
+		squares += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(squares/float64(len(last)))/mean < rpmStability
+}
+
+// zeroReader is an endless stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// Print writes r as cf_rpm_* lines, one metric per line.
+func (r *RPMResult) Print(w io.Writer) error {
+	var err error
+	printf := func(format string, a ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, a...)
+		}
+	}
+
+	printf("cf_rpm_start_timestamp %v\n", r.Start.Unix())
+	for _, d := range []Responsiveness{r.Download, r.Upload} {
+		if d.Direction == "" {
+			continue
+		}
+		printf("cf_rpm_%v %.0f\n", d.Direction, d.RPM)
+		printf("cf_rpm_%v_foreign %.0f\n", d.Direction, d.ForeignRPM)
+		printf("cf_rpm_%v_self %.0f\n", d.Direction, d.SelfRPM)
+		printf("cf_rpm_%v_tcp_ms %.2f\n", d.Direction, ms(d.TCP))
+		printf("cf_rpm_%v_tls_ms %.2f\n", d.Direction, ms(d.TLS))
+		printf("cf_rpm_%v_http_ms %.2f\n", d.Direction, ms(d.HTTP))
+		printf("cf_rpm_%v_self_ms %.2f\n", d.Direction, ms(d.Self))
+		printf("cf_rpm_%v_Mbps %.2f\n", d.Direction, d.BitsPerSecond/1e6)
+		printf("cf_rpm_%v_connections %d\n", d.Direction, d.Connections)
+		printf("cf_rpm_%v_load_succeeded %d\n", d.Direction, d.LoadSucceeded)
+		printf("cf_rpm_%v_load_failed %d\n", d.Direction, d.LoadFailed)
+		printf("cf_rpm_%v_self_reused %d\n", d.Direction, d.SelfReused)
+		saturated := 0
+		if d.Saturated {
+			saturated = 1
+		}
+		printf("cf_rpm_%v_saturated %d\n", d.Direction, saturated)
+	}
+	return err
+}
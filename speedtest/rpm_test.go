@@ -0,0 +1,69 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testRPMOptions = RPMOptions{
+	MaxDuration:    time.Second,
+	Interval:       200 * time.Millisecond,
+	ProbeInterval:  50 * time.Millisecond,
+	MaxConnections: 4,
+}
+
+func TestResponsiveness(t *testing.T) {
+	ts := newTestServer(t)
+	s := NewSpeedtest(nil, nil)
+	s.BaseURL = ts.URL
+	r, err := s.Responsiveness(context.Background(), ts.URL+RPMConfigPath, testRPMOptions)
+	if err != nil {
+		t.Fatalf("Responsiveness: %v", err)
+	}
+	for _, d := range []Responsiveness{r.Download, r.Upload} {
+		if d.RPM <= 0 || d.BitsPerSecond <= 0 {
+			t.Errorf("%s: %.0f RPM at %.0f bits/s", d.Direction, d.RPM, d.BitsPerSecond)
+		}
+		if len(d.ForeignProbes) == 0 || len(d.SelfProbes) == 0 {
+			t.Errorf("%s: %d foreign and %d self probes", d.Direction, len(d.ForeignProbes), len(d.SelfProbes))
+		}
+		if d.LoadSucceeded == 0 || d.LoadFailed > 0 {
+			t.Errorf("%s: %d load transfers succeeded, %d failed: %s", d.Direction, d.LoadSucceeded, d.LoadFailed, d.LoadError)
+		}
+	}
+}
+
+func TestResponsivenessWithoutLoad(t *testing.T) {
+	srv := NewServer()
+	mux := http.NewServeMux()
+	mux.Handle("/", srv)
+	var ts *httptest.Server
+	mux.HandleFunc(RPMConfigPath, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(RPMConfig{Version: 1, URLs: RPMURLs{
+			SmallDownloadURL: ts.URL + DefaultDownloadPath + "?bytes=1",
+			// larger than the server allows
+			LargeDownloadURL: ts.URL + DefaultDownloadPath + "?bytes=2000000000",
+			UploadURL:        ts.URL + DefaultUploadPath,
+		}})
+	})
+	ts = httptest.NewServer(mux)
+	defer ts.Close()
+
+	s := NewSpeedtest(nil, nil)
+	r, err := s.Responsiveness(context.Background(), ts.URL+RPMConfigPath, testRPMOptions)
+	if err == nil || !strings.Contains(err.Error(), "no load transfer succeeded") {
+		t.Fatalf("Responsiveness = %v, want an error for the missing load", err)
+	}
+	if r.Download.LoadFailed == 0 || r.Download.LoadError == "" {
+		t.Errorf("load failures not reported: %+v", r.Download)
+	}
+	// failed transfers are retried after a backoff, not in a tight loop
+	if r.Download.LoadFailed > 20 {
+		t.Errorf("%d failed load transfers in %v", r.Download.LoadFailed, testRPMOptions.MaxDuration)
+	}
+}
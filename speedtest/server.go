@@ -0,0 +1,212 @@
+package speedtest
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TracePath is the metadata endpoint served next to the download and upload endpoints.
+const TracePath = "/cdn-cgi/trace"
+
+// Server implements the HTTP protocol spoken by speed.cloudflare.com, so that
+// links inside private networks can be measured without the public edge.
+//
+//	GET  /__down?bytes=N  streams N bytes
+//	POST /__up            drains the request body
+//	GET  /cdn-cgi/trace   returns key=value metadata about the request
+//	GET  /.well-known/nq  returns the responsiveness (RPM) config pointing at the above
+//
+// Every response carries a Server-Timing header with the time the server
+// spent on the request, so clients can subtract it from their measurements.
+// For uploads it only covers the time after the body was received.
+type Server struct {
+	// MaxBytes caps the size of a single download.
+	MaxBytes int64
+	// Colo is reported as the colo field of the trace endpoint.
+	Colo string
+
+	mux *http.ServeMux
+}
+
+// zeros is the payload streamed by download responses.
+var zeros = make([]byte, 64*1024)
+
+func NewServer() *Server {
+	srv := &Server{
+		MaxBytes: 1 << 30,
+		Colo:     "local",
+		mux:      http.NewServeMux(),
+	}
+	srv.mux.HandleFunc(DefaultDownloadPath, srv.handleDownload)
+	srv.mux.HandleFunc(DefaultUploadPath, srv.handleUpload)
+	srv.mux.HandleFunc(TracePath, srv.handleTrace)
+	srv.mux.HandleFunc(RPMConfigPath, srv.handleRPMConfig)
+	return srv
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Timing-Allow-Origin", "*")
+	srv.mux.ServeHTTP(w, r)
+}
+
+// serverTiming formats d as a Server-Timing header value in the same shape as Cloudflare.
+func serverTiming(d time.Duration) string {
+	return fmt.Sprintf("cfRequestDuration;dur=%.6f", float64(d)/float64(time.Millisecond))
+}
+
+// parseServerTiming returns the duration of the cfRequestDuration metric in
+// the Server-Timing header values, or of the first metric with a duration
+// if there is none by that name.
+func parseServerTiming(values []string) (time.Duration, bool) {
+	var first time.Duration
+	var found bool
+	for _, v := range values {
+		for _, metric := range strings.Split(v, ",") {
+			params := strings.Split(metric, ";")
+			name := strings.TrimSpace(params[0])
+			for _, param := range params[1:] {
+				key, value, ok := strings.Cut(param, "=")
+				if !ok || !strings.EqualFold(strings.TrimSpace(key), "dur") {
+					continue
+				}
+				ms, err := strconv.ParseFloat(strings.Trim(strings.TrimSpace(value), `"`), 64)
+				if err != nil || ms < 0 {
+					continue
+				}
+				d := time.Duration(ms * float64(time.Millisecond))
+				if name == "cfRequestDuration" {
+					return d, true
+				}
+				if !found {
+					first, found = d, true
+				}
+			}
+		}
+	}
+	return first, found
+}
+
+func (srv *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var n int64
+	if v := r.URL.Query().Get("bytes"); v != "" {
+		var err error
+		n, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid bytes parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if n > srv.MaxBytes {
+		http.Error(w, "bytes parameter exceeds "+strconv.FormatInt(srv.MaxBytes, 10), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+	w.Header().Set("Server-Timing", serverTiming(time.Since(start)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	for n > 0 {
+		chunk := zeros
+		if n < int64(len(chunk)) {
+			chunk = chunk[:n]
+		}
+		written, err := w.Write(chunk)
+		if err != nil {
+			return
+		}
+		n -= int64(written)
+	}
+}
+
+func (srv *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := io.Copy(io.Discard, r.Body); err != nil {
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+	// receiving the body is part of the transfer, not of the processing
+	start := time.Now()
+
+	w.Header().Set("Server-Timing", serverTiming(time.Since(start)))
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleRPMConfig points the responsiveness test at the download and
+// upload endpoints of this server, under the host and scheme it was reached by.
+func (srv *Server) handleRPMConfig(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	base := scheme + "://" + r.Host
+	cfg := RPMConfig{
+		Version: 1,
+		URLs: RPMURLs{
+			SmallDownloadURL: base + DefaultDownloadPath + "?bytes=1",
+			LargeDownloadURL: base + DefaultDownloadPath + "?bytes=" + strconv.FormatInt(srv.MaxBytes, 10),
+			UploadURL:        base + DefaultUploadPath,
+		},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cfg)
+}
+
+func (srv *Server) handleTrace(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	scheme, tlsVersion, sni := "http", "off", ""
+	if r.TLS != nil {
+		scheme = "https"
+		tlsVersion = tls.VersionName(r.TLS.Version)
+		sni = r.TLS.ServerName
+	}
+	if sni == "" {
+		sni = "off"
+	}
+
+	fields := [][2]string{
+		{"h", r.Host},
+		{"ip", ip},
+		{"ts", fmt.Sprintf("%.3f", float64(time.Now().UnixMilli())/1e3)},
+		{"visit_scheme", scheme},
+		{"uag", r.UserAgent()},
+		{"colo", srv.Colo},
+		{"http", strings.ToLower(r.Proto)},
+		{"tls", tlsVersion},
+		{"sni", sni},
+	}
+	var b strings.Builder
+	for _, f := range fields {
+		b.WriteString(f[0] + "=" + f[1] + "\n")
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Server-Timing", serverTiming(time.Since(start)))
+	io.WriteString(w, b.String())
+}
@@ -0,0 +1,194 @@
+package speedtest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := NewServer()
+	srv.MaxBytes = 10 << 20
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestServerDownload(t *testing.T) {
+	ts := newTestServer(t)
+	for _, tc := range []struct {
+		query  string
+		status int
+		bytes  int
+	}{
+		{"?bytes=0", http.StatusOK, 0},
+		{"?bytes=100000", http.StatusOK, 100000},
+		{"", http.StatusOK, 0},
+		{"?bytes=-1", http.StatusBadRequest, -1},
+		{"?bytes=x", http.StatusBadRequest, -1},
+		{"?bytes=10485761", http.StatusBadRequest, -1},
+	} {
+		resp, err := http.Get(ts.URL + DefaultDownloadPath + tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.status {
+			t.Errorf("%q: status %d, want %d", tc.query, resp.StatusCode, tc.status)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		if len(body) != tc.bytes || strings.Trim(string(body), "\x00") != "" {
+			t.Errorf("%q: got %d bytes, want %d zeros", tc.query, len(body), tc.bytes)
+		}
+		if _, ok := parseServerTiming(resp.Header.Values("Server-Timing")); !ok {
+			t.Errorf("%q: no Server-Timing in %q", tc.query, resp.Header.Values("Server-Timing"))
+		}
+		if got := resp.Header.Get("Cache-Control"); got != "no-store" {
+			t.Errorf("%q: Cache-Control %q, want no-store", tc.query, got)
+		}
+	}
+
+	resp, err := http.Post(ts.URL+DefaultDownloadPath, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST download: status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestServerUpload(t *testing.T) {
+	ts := newTestServer(t)
+	resp, err := http.Post(ts.URL+DefaultUploadPath, "application/octet-stream", io.LimitReader(zeroReader{}, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	d, ok := parseServerTiming(resp.Header.Values("Server-Timing"))
+	if !ok {
+		t.Fatalf("no Server-Timing in %q", resp.Header.Values("Server-Timing"))
+	}
+	// receiving the body is not part of the processing time
+	if d > 100*time.Millisecond {
+		t.Errorf("Server-Timing %v includes the upload", d)
+	}
+
+	resp, err = http.Get(ts.URL + DefaultUploadPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET upload: status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestServerTrace(t *testing.T) {
+	ts := newTestServer(t)
+	resp, err := http.Get(ts.URL + TracePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{"colo=local\n", "visit_scheme=http\n", "ip=127.0.0.1\n", "tls=off\n"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("trace %q lacks %q", body, want)
+		}
+	}
+}
+
+// TestServerRun runs a whole speedtest against the built-in server.
+func TestServerRun(t *testing.T) {
+	ts := newTestServer(t)
+	s := NewSpeedtest(
+		[]Test{{NumBytes: 100000, Iterations: 2, Name: "100kB"}},
+		[]Test{{NumBytes: 100000, Iterations: 2, Name: "100kB"}, {NumBytes: 100000, Iterations: 1, Streams: 2, Name: "2x100kB"}},
+	)
+	s.BaseURL = ts.URL
+	s.LatencyReps = 3
+	r, err := s.RunAllTests(context.Background())
+	if err != nil {
+		t.Fatalf("RunAllTests: %v", err)
+	}
+	if len(r.LatencySamples) != 3 || r.Latency <= 0 {
+		t.Errorf("latency %v from %d probes", r.Latency, len(r.LatencySamples))
+	}
+	for _, tr := range append(append([]TestResult{}, r.Download...), r.Upload...) {
+		if tr.Failed > 0 || tr.Succeeded != tr.Test.Iterations {
+			t.Errorf("%s: %d succeeded, %d failed: %v", tr.Test.Name, tr.Succeeded, tr.Failed, tr.Samples)
+		}
+		if tr.BitsPerSecond <= 0 {
+			t.Errorf("%s: no throughput", tr.Test.Name)
+		}
+		for _, x := range tr.Samples {
+			if x.ServerTiming <= 0 && len(x.Streams) == 0 {
+				t.Errorf("%s: Server-Timing not picked up", tr.Test.Name)
+			}
+			if len(x.Streams) == 0 && x.Bytes != int64(tr.Test.NumBytes) {
+				t.Errorf("%s: moved %d bytes, want %d", tr.Test.Name, x.Bytes, tr.Test.NumBytes)
+			}
+		}
+	}
+}
+
+func TestParseServerTiming(t *testing.T) {
+	for _, tc := range []struct {
+		values []string
+		want   time.Duration
+		ok     bool
+	}{
+		{nil, 0, false},
+		{[]string{"cfRequestDuration;dur=12.5"}, 12500 * time.Microsecond, true},
+		{[]string{`cache;desc="hit";dur=2, cfRequestDuration;dur=5`}, 5 * time.Millisecond, true},
+		{[]string{"cache;dur=2", "cfRequestDuration;desc=x;dur=5"}, 5 * time.Millisecond, true},
+		{[]string{"db;dur=3, app;dur=4"}, 3 * time.Millisecond, true},
+		{[]string{`app;DUR="1.5"`}, 1500 * time.Microsecond, true},
+		{[]string{"miss", "app;desc=x"}, 0, false},
+		{[]string{"app;dur=-1", "app;dur=x"}, 0, false},
+		{[]string{serverTiming(42 * time.Microsecond)}, 42 * time.Microsecond, true},
+	} {
+		got, ok := parseServerTiming(tc.values)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("parseServerTiming(%q) = %v, %v, want %v, %v", tc.values, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestServerRunWithoutBytes(t *testing.T) {
+	ts := newTestServer(t)
+	s := NewSpeedtest(nil, []Test{{NumBytes: 0, Iterations: 1, Streams: 2, Name: "2x0B"}})
+	s.BaseURL = ts.URL
+	s.LatencyReps = 1
+	r, err := s.RunAllTests(context.Background())
+	if err != nil {
+		t.Fatalf("RunAllTests: %v", err)
+	}
+	tr := r.Download[0]
+	if tr.Succeeded != 1 || tr.Fairness != 0 || tr.Samples[0].Fairness != 0 {
+		t.Errorf("%d succeeded, fairness %v of %v, want no fairness without throughput", tr.Succeeded, tr.Fairness, tr.Samples[0].Fairness)
+	}
+	var out strings.Builder
+	if err := WriteJSON(&out, r); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	if !strings.Contains(out.String(), `"fairness": null`) {
+		t.Errorf("fairness not null: %s", out.String())
+	}
+}
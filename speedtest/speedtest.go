@@ -4,10 +4,10 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"mime"
 	"net"
 	"net/http"
@@ -17,46 +17,25 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
-
-	"cfspeedtest/stats"
-	"cfspeedtest/timeCalculations"
 )
 
 var (
 	// tr = &http.Transport{
 	// 	TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	// }
-	umt             = time.Now()
-	start_timestamp = umt.Unix()
-
 	//client = &http.Client{Transport: tr, Timeout: 10 * time.Second}
 
 	latencyreps = 20
 	userAgent   = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/113.0.0.0 Safari/537.36"
-	// Command line flags.
-	httpMethod      string
-	postBody        string
-	followRedirects bool
-	onlyHeader      bool
-	insecure        bool
-	httpHeaders     headers
-	saveOutput      bool
-	outputFile      string
-	showVersion     bool
-	clientCertFile  string
-	fourOnly        bool
-	sixOnly         bool
-
-	// number of redirects followed
-	redirectsFollowed int
-
-	version = "devel" // for -v flag, updated during the release process with -ldflags=-X=main.version=...
 )
 
-type headers []string
+// Headers holds "Name: value" request headers and can be used as a
+// repeatable flag. Sorting it orders header names for display.
+type Headers []string
 
-func (h headers) String() string {
+func (h Headers) String() string {
 	var o []string
 	for _, v := range h {
 		o = append(o, "-H "+v)
@@ -64,14 +43,14 @@ func (h headers) String() string {
 	return strings.Join(o, " ")
 }
 
-func (h *headers) Set(v string) error {
+func (h *Headers) Set(v string) error {
 	*h = append(*h, v)
 	return nil
 }
 
-func (h headers) Len() int      { return len(h) }
-func (h headers) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
-func (h headers) Less(i, j int) bool {
+func (h Headers) Len() int      { return len(h) }
+func (h Headers) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h Headers) Less(i, j int) bool {
 	a, b := h[i], h[j]
 
 	// server always sorts at the top
@@ -107,20 +86,226 @@ func (h headers) Less(i, j int) bool {
 	return x
 }
 
+// Address families for Speedtest.Family.
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+	FamilyBoth = "both"
+)
+
+// ErrUnreachable is returned when none of the latency probes could connect to the server.
+var ErrUnreachable = errors.New("server unreachable")
+
+// Default endpoints of the public Cloudflare speedtest.
+const (
+	DefaultBaseURL      = "http://speed.cloudflare.com"
+	DefaultDownloadPath = "/__down"
+	DefaultUploadPath   = "/__up"
+	DefaultLatencyPath  = "/__down"
+)
+
+// DefaultIterationTimeout keeps a stalled transfer from hanging a run.
+const DefaultIterationTimeout = 30 * time.Second
+
 type Speedtest struct {
 	UploadTests, DownloadTests []Test
+
+	// BaseURL is the scheme, host and optional path prefix of the
+	// speedtest server, e.g. "https://speed.example.com/mirror".
+	BaseURL string
+	// DownloadPath, UploadPath and LatencyPath are resolved against BaseURL.
+	DownloadPath, UploadPath, LatencyPath string
+
+	// LatencyReps is the number of idle latency probes.
+	LatencyReps int
+	// Adaptive, if set, sizes the download and upload tests as it
+	// describes instead of running every one of them.
+	Adaptive *Adaptive
+	// ProgressInterval is how often transfers record the bytes they have
+	// moved so far. Zero records no progress.
+	ProgressInterval time.Duration
+
+	// LoadDuration enables the latency under load measurement: for this
+	// long, LoadStreams concurrent transfers of LoadBytes each saturate
+	// first the download and then the upload, while latency probes are
+	// sent every LoadProbeInterval. Zero skips the measurement.
+	LoadDuration      time.Duration
+	LoadStreams       int
+	LoadBytes         int
+	LoadProbeInterval time.Duration
+
+	// Family selects the address family: FamilyIPv4, FamilyIPv6 or
+	// FamilyBoth, which runs the whole plan once per family with RunFamilies.
+	// Empty means FamilyIPv4.
+	Family string
+	// Insecure skips the verification of the server certificate.
+	Insecure bool
+	// ClientCertFile is a PEM file with a client certificate and its private key.
+	ClientCertFile string
+	// Headers are added to every request; a Host header overrides the request host.
+	Headers Headers
+
+	// IterationTimeout bounds a single request including its body transfer,
+	// DefaultIterationTimeout unless changed; it does not apply to the load
+	// of the latency under load and responsiveness tests, which lasts as
+	// long as the test. RunTimeout bounds RunAllTests as a whole. Zero
+	// means no limit.
+	IterationTimeout, RunTimeout time.Duration
 }
 
 func NewSpeedtest(UploadTests []Test, DownloadTests []Test) *Speedtest {
 	return &Speedtest{
 		UploadTests:   UploadTests,
 		DownloadTests: DownloadTests,
+		BaseURL:       DefaultBaseURL,
+		DownloadPath:  DefaultDownloadPath,
+		UploadPath:    DefaultUploadPath,
+		LatencyPath:   DefaultLatencyPath,
+		LatencyReps:   latencyreps,
+
+		IterationTimeout: DefaultIterationTimeout,
+
+		ProgressInterval: 100 * time.Millisecond,
+
+		LoadStreams:       4,
+		LoadBytes:         25000000,
+		LoadProbeInterval: 200 * time.Millisecond,
+	}
+}
+
+// Validate checks that the base URL, every endpoint path, the network and
+// the headers are usable.
+func (s *Speedtest) Validate() error {
+	for _, p := range []string{s.DownloadPath, s.UploadPath, s.LatencyPath} {
+		if _, err := s.endpoint(p, nil); err != nil {
+			return err
+		}
+	}
+	switch s.Family {
+	case "", FamilyIPv4, FamilyIPv6, FamilyBoth:
+	default:
+		return fmt.Errorf("unsupported address family %q: must be %s, %s or %s", s.Family, FamilyIPv4, FamilyIPv6, FamilyBoth)
+	}
+	if s.LoadDuration > 0 && (s.LoadStreams < 1 || s.LoadBytes < 1 || s.LoadProbeInterval <= 0) {
+		return fmt.Errorf("latency under load needs at least one stream, a positive transfer size and probe interval")
+	}
+	if s.Adaptive != nil {
+		if err := s.Adaptive.validate(); err != nil {
+			return err
+		}
+	}
+	if s.ProgressInterval < 0 {
+		return fmt.Errorf("progress interval must not be negative, got %v", s.ProgressInterval)
+	}
+	for _, t := range append(append([]Test{}, s.DownloadTests...), s.UploadTests...) {
+		if t.Streams < 0 {
+			return fmt.Errorf("test %s: streams must not be negative, got %d", t.Name, t.Streams)
+		}
 	}
+	for _, h := range s.Headers {
+		if _, _, err := headerKeyValue(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// family returns the address family of a single family run.
+func (s *Speedtest) family() string {
+	if s.Family == "" {
+		return FamilyIPv4
+	}
+	return s.Family
+}
+
+// network returns the dial network.
+func (s *Speedtest) network() string {
+	if s.family() == FamilyIPv6 {
+		return "tcp6"
+	}
+	return "tcp4"
+}
+
+// newClient returns a client with a fresh transport, so every request opens
+// its own connection. Redirects are never followed.
+func (s *Speedtest) newClient(target *url.URL, host string, certificates []tls.Certificate) (*http.Client, *http.Transport) {
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+	t.DialContext = dialContext(s.network())
+	switch target.Scheme {
+	case "https":
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		t.TLSClientConfig = &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: s.Insecure,
+			Certificates:       certificates,
+			MinVersion:         tls.VersionTLS12,
+		}
+	}
+
+	client := &http.Client{
+		Transport: t,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// always refuse to follow redirects, visit does that
+			// manually if required.
+			return http.ErrUseLastResponse
+		},
+	}
+	return client, t
+}
+
+// setHeaders adds the configured headers to req.
+func setHeaders(req *http.Request, hdrs Headers) error {
+	for _, h := range hdrs {
+		k, v, err := headerKeyValue(h)
+		if err != nil {
+			return err
+		}
+		if strings.EqualFold(k, "host") {
+			req.Host = v
+			continue
+		}
+		req.Header.Add(k, v)
+	}
+	return nil
+}
+
+// endpoint resolves the path p against the base URL and merges query into it.
+func (s *Speedtest) endpoint(p string, query url.Values) (*url.URL, error) {
+	base, err := parseURL(s.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := url.Parse(p)
+	if err != nil || ref.Scheme != "" || ref.Host != "" || !strings.HasPrefix(ref.Path, "/") {
+		return nil, fmt.Errorf("invalid endpoint path %q: must be an absolute path such as %q", p, DefaultDownloadPath)
+	}
+
+	u := *base
+	u.Path = path.Join("/", base.Path, ref.Path)
+	q := ref.Query()
+	for k, v := range query {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return &u, nil
 }
 
 type Test struct {
 	NumBytes, Iterations int
 	Name                 string
+	// Streams is the number of concurrent transfers of NumBytes each in
+	// every iteration. 0 and 1 mean a single transfer.
+	Streams int
 }
 
 func NewTest(NumBytes int, Iterations int, Name string) *Test {
@@ -150,9 +335,9 @@ func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return http.DefaultTransport.RoundTrip(req)
 }
 
-func readClientCert(filename string) []tls.Certificate {
+func readClientCert(filename string) ([]tls.Certificate, error) {
 	if filename == "" {
-		return nil
+		return nil, nil
 	}
 	var (
 		pkeyPem []byte
@@ -162,7 +347,7 @@ func readClientCert(filename string) []tls.Certificate {
 	// read client certificate file (must include client private key and certificate)
 	certFileBytes, err := ioutil.ReadFile(filename)
 	if err != nil {
-		log.Fatalf("failed to read client certificate file: %v", err)
+		return nil, fmt.Errorf("failed to read client certificate file: %v", err)
 	}
 
 	for {
@@ -182,19 +367,35 @@ func readClientCert(filename string) []tls.Certificate {
 
 	cert, err := tls.X509KeyPair(certPem, pkeyPem)
 	if err != nil {
-		log.Fatalf("unable to load client cert and key pair: %v", err)
+		return nil, fmt.Errorf("unable to load client cert and key pair: %v", err)
 	}
-	return []tls.Certificate{cert}
+	return []tls.Certificate{cert}, nil
 }
 
-func parseURL(uri string) *url.URL {
+// parseURL parses a base url, which must not have a query or fragment.
+func parseURL(uri string) (*url.URL, error) {
+	url, err := normalizeURL(uri)
+	if err != nil {
+		return nil, err
+	}
+	if url.RawQuery != "" || url.Fragment != "" {
+		return nil, fmt.Errorf("url %q must not contain a query or fragment", uri)
+	}
+	return url, nil
+}
+
+// normalizeURL parses uri, defaulting to https unless the port is 80.
+func normalizeURL(uri string) (*url.URL, error) {
+	if uri == "" {
+		return nil, fmt.Errorf("empty url")
+	}
 	if !strings.Contains(uri, "://") && !strings.HasPrefix(uri, "//") {
 		uri = "//" + uri
 	}
 
 	url, err := url.Parse(uri)
 	if err != nil {
-		log.Fatalf("could not parse url %q: %v", uri, err)
+		return nil, fmt.Errorf("could not parse url %q: %v", uri, err)
 	}
 
 	if url.Scheme == "" {
@@ -203,15 +404,21 @@ func parseURL(uri string) *url.URL {
 			url.Scheme += "s"
 		}
 	}
-	return url
+	if url.Scheme != "http" && url.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q in url %q: must be http or https", url.Scheme, uri)
+	}
+	if url.Host == "" {
+		return nil, fmt.Errorf("missing host in url %q", uri)
+	}
+	return url, nil
 }
 
-func headerKeyValue(h string) (string, string) {
+func headerKeyValue(h string) (string, string, error) {
 	i := strings.Index(h, ":")
 	if i == -1 {
-		fmt.Printf("Header '%s' has invalid format, missing ':'", h)
+		return "", "", fmt.Errorf("header '%s' has invalid format, missing ':'", h)
 	}
-	return strings.TrimRight(h[:i], " "), strings.TrimLeft(h[i:], " :")
+	return strings.TrimRight(h[:i], " "), strings.TrimLeft(h[i:], " :"), nil
 }
 
 func dialContext(network string) func(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -227,32 +434,31 @@ func isRedirect(resp *http.Response) bool {
 	return resp.StatusCode > 299 && resp.StatusCode < 400
 }
 
-func newRequest(method string, url *url.URL, body string) *http.Request {
-	req, err := http.NewRequest(method, url.String(), createBody(body))
+func newRequest(method string, url *url.URL, body string, hdrs Headers) (*http.Request, error) {
+	reqBody, err := createBody(body)
 	if err != nil {
-		log.Fatalf("unable to create request: %v", err)
+		return nil, err
 	}
-	for _, h := range httpHeaders {
-		k, v := headerKeyValue(h)
-		if strings.EqualFold(k, "host") {
-			req.Host = v
-			continue
-		}
-		req.Header.Add(k, v)
+	req, err := http.NewRequest(method, url.String(), reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request: %v", err)
+	}
+	if err := setHeaders(req, hdrs); err != nil {
+		return nil, err
 	}
-	return req
+	return req, nil
 }
 
-func createBody(body string) io.Reader {
+func createBody(body string) (io.Reader, error) {
 	if strings.HasPrefix(body, "@") {
 		filename := body[1:]
 		f, err := os.Open(filename)
 		if err != nil {
-			log.Fatalf("failed to open data file %s: %v", filename, err)
+			return nil, fmt.Errorf("failed to open data file %s: %v", filename, err)
 		}
-		return f
+		return f, nil
 	}
-	return strings.NewReader(body)
+	return strings.NewReader(body), nil
 }
 
 // getFilenameFromHeaders tries to automatically determine the output filename,
@@ -281,9 +487,9 @@ func getFilenameFromHeaders(headers http.Header) string {
 // readResponseBody consumes the body of the response.
 // readResponseBody returns an informational message about the
 // disposition of the response body's contents.
-func readResponseBody(req *http.Request, resp *http.Response) string {
+func readResponseBody(req *http.Request, resp *http.Response, saveOutput bool, outputFile string) (string, error) {
 	if isRedirect(resp) || req.Method == http.MethodHead {
-		return ""
+		return "", nil
 	}
 
 	w := ioutil.Discard
@@ -300,325 +506,445 @@ func readResponseBody(req *http.Request, resp *http.Response) string {
 			}
 
 			if filename == "/" {
-				log.Fatalf("No remote filename; specify output filename with -o to save response body")
+				return "", fmt.Errorf("no remote filename; specify an output filename to save the response body")
 			}
 		}
 
 		f, err := os.Create(filename)
 		if err != nil {
-			log.Fatalf("unable to create file %s: %v", filename, err)
+			return "", fmt.Errorf("unable to create file %s: %v", filename, err)
 		}
 		defer f.Close()
 		w = f
 		msg = "Body read"
 	}
 
-	if _, err := io.Copy(w, resp.Body); err != nil && w != ioutil.Discard {
-		fmt.Fprintf(os.Stderr, "failed to read response body "+err.Error())
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return "", fmt.Errorf("failed to read response body: %v", err)
 	}
 
-	return msg
+	return msg, nil
 }
 
 // runs download tests
-func (s *Speedtest) Download(numbytes int, iterations int) ([]time.Duration, []time.Duration, []time.Duration, []time.Duration, []time.Duration) {
-	var fulltimes []time.Duration
-	var servertimes []time.Duration
-	var dnstimes []time.Duration
-	var tcptimes []time.Duration
-	var transfertimes []time.Duration
+func (s *Speedtest) Download(ctx context.Context, numbytes int, iterations int) ([]Sample, error) {
+	return s.download(ctx, numbytes, iterations, 1)
+}
+
+func (s *Speedtest) download(ctx context.Context, numbytes, iterations, streams int) ([]Sample, error) {
+	download_url, err := s.endpoint(s.DownloadPath, url.Values{"bytes": {strconv.Itoa(numbytes)}})
+	if err != nil {
+		return nil, err
+	}
+	return s.measure(ctx, download_url, numbytes, iterations, streams, func() (*http.Request, error) {
+		return http.NewRequest("GET", download_url.String(), nil)
+	})
+}
 
-	download_url := parseURL("http://speed.cloudflare.com/__down?bytes=" + strconv.Itoa(numbytes))
+// runs latency probes, which are empty downloads from the latency endpoint
+func (s *Speedtest) Latency(ctx context.Context, iterations int) ([]Sample, error) {
+	latency_url, err := s.endpoint(s.LatencyPath, url.Values{"bytes": {"0"}})
+	if err != nil {
+		return nil, err
+	}
+	// the latency endpoint is not checked, it may be any small resource
+	return s.measure(ctx, latency_url, -1, iterations, 1, func() (*http.Request, error) {
+		return http.NewRequest("GET", latency_url.String(), nil)
+	})
+}
 
-	//visit(url)
+// runs upload tests
+func (s *Speedtest) Upload(ctx context.Context, numbytes int, iterations int) ([]Sample, error) {
+	return s.upload(ctx, numbytes, iterations, 1)
+}
 
+func (s *Speedtest) upload(ctx context.Context, numbytes, iterations, streams int) ([]Sample, error) {
+	upload_url, err := s.endpoint(s.UploadPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.measure(ctx, upload_url, numbytes, iterations, streams, func() (*http.Request, error) {
+		return newUploadRequest(upload_url, numbytes)
+	})
+}
+
+// newUploadRequest posts numbytes zeros to u as a raw binary body. The body
+// is generated while it is sent, so uploads of any size take no memory.
+func newUploadRequest(u *url.URL, numbytes int) (*http.Request, error) {
+	body := func() io.ReadCloser { return io.NopCloser(io.LimitReader(zeroReader{}, int64(numbytes))) }
+	req, err := http.NewRequest("POST", u.String(), body())
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(numbytes)
+	req.GetBody = func() (io.ReadCloser, error) { return body(), nil }
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return req, nil
+}
+
+// measure times iterations of the request built by newReq against target,
+// with streams concurrent requests per iteration if streams is above 1.
+// Every request is expected to move numbytes bytes in its body, unless
+// numbytes is negative.
+// It returns one sample per iteration; failed iterations carry their error
+// and the phase they failed in. The error is only set if the requests could
+// not be set up at all, or if ctx is done, in which case the samples
+// measured so far are returned with it.
+func (s *Speedtest) measure(ctx context.Context, target *url.URL, numbytes, iterations, streams int, newReq func() (*http.Request, error)) ([]Sample, error) {
+	certificates, err := readClientCert(s.ClientCertFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []Sample
 	for i := 0; i < iterations; i++ {
-		//t := &transport{}
-		req, _ := http.NewRequest("GET", download_url.String(), nil)
-		var t0, t1, t2, t3, t4, t5, t6 time.Time
-		trace := &httptrace.ClientTrace{
-			DNSStart: func(_ httptrace.DNSStartInfo) { t0 = time.Now() },
-			DNSDone:  func(_ httptrace.DNSDoneInfo) { t1 = time.Now() },
-			ConnectStart: func(_, _ string) {
-				if t1.IsZero() {
-					// connecting to IP
-					t1 = time.Now()
-				}
-			},
-			ConnectDone: func(net, addr string, err error) {
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "unable to connect to host "+addr+" "+err.Error())
-				}
-				t2 = time.Now()
-				//printf("\n%s%s\n", color.GreenString("Connected to "), color.CyanString(addr))
-			},
-			GotConn:              func(_ httptrace.GotConnInfo) { t3 = time.Now() },
-			GotFirstResponseByte: func() { t4 = time.Now() },
-			TLSHandshakeStart:    func() { t5 = time.Now() },
-			TLSHandshakeDone:     func(_ tls.ConnectionState, _ error) { t6 = time.Now() },
-		}
-		req = req.WithContext(httptrace.WithClientTrace(context.Background(), trace))
-		req.Header.Set("User-Agent", userAgent)
-		t := &http.Transport{
-			Proxy:                 http.ProxyFromEnvironment,
-			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-			ForceAttemptHTTP2:     true,
-		}
-		t.DialContext = dialContext("tcp4")
-		switch download_url.Scheme {
-		case "https":
-			host, _, err := net.SplitHostPort(req.Host)
-			if err != nil {
-				host = req.Host
-			}
+		if err := ctx.Err(); err != nil {
+			return samples, err
+		}
+		if streams > 1 {
+			samples = append(samples, s.streams(ctx, target, certificates, streams, numbytes, newReq))
+		} else {
+			samples = append(samples, checkBytes(s.iteration(ctx, target, certificates, nil, newReq, nil), numbytes))
+		}
+		samples[i].Iteration = i
+	}
+	return samples, ctx.Err()
+}
+
+// checkBytes fails a successful iteration that did not move exactly want
+// bytes, such as a download cut short by the server.
+func checkBytes(x Sample, want int) Sample {
+	if want >= 0 && x.OK() && x.Bytes != int64(want) {
+		return Sample{Phase: PhaseIntegrity, Status: x.Status, Bytes: x.Bytes, Err: fmt.Errorf("moved %d of %d bytes", x.Bytes, want)}
+	}
+	return x
+}
+
+// iteration runs and times a single request. If client is nil, the request
+// gets a fresh transport and thus a new connection. The bytes of the
+// request body, or of the response body if there is none, are counted; the
+// response body is discarded as it arrives. The transfer of a request body
+// is timed from the first byte written until it was written completely and
+// the server responded. If w is set, the request is one stream of a
+// multi-stream iteration and the counted bytes also go into w.
+func (s *Speedtest) iteration(ctx context.Context, target *url.URL, certificates []tls.Certificate, client *http.Client, newReq func() (*http.Request, error), w *streamWindow) (x Sample) {
+	if s.IterationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.IterationTimeout)
+		defer cancel()
+	}
+	defer func() {
+		if x.Err != nil && ctx.Err() == context.DeadlineExceeded {
+			x.TimedOut = true
+			x.Err = fmt.Errorf("timed out: %v", x.Err)
+		}
+	}()
+
+	req, err := newReq()
+	if err == nil {
+		err = setHeaders(req, s.Headers)
+	}
+	if err != nil {
+		return Sample{Phase: PhaseRequest, Err: err}
+	}
 
-			t.TLSClientConfig = &tls.Config{
-				ServerName:         host,
-				InsecureSkipVerify: insecure,
-				Certificates:       readClientCert(clientCertFile),
-				MinVersion:         tls.VersionTLS12,
+	var t0, t1, t2, t3, t4, t5, t6 time.Time
+	var conn httptrace.GotConnInfo
+	// the request may be written after the response arrived
+	var wroteMu sync.Mutex
+	var wrote time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(_ httptrace.DNSStartInfo) { t0 = time.Now() },
+		DNSDone:  func(_ httptrace.DNSDoneInfo) { t1 = time.Now() },
+		ConnectStart: func(_, _ string) {
+			if t1.IsZero() {
+				// connecting to IP
+				t1 = time.Now()
 			}
+		},
+		ConnectDone: func(_, _ string, _ error) { t2 = time.Now() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t3 = time.Now()
+			conn = info
+		},
+		WroteRequest: func(_ httptrace.WroteRequestInfo) {
+			wroteMu.Lock()
+			wrote = time.Now()
+			wroteMu.Unlock()
+		},
+		GotFirstResponseByte: func() { t4 = time.Now() },
+		TLSHandshakeStart:    func() { t5 = time.Now() },
+		TLSHandshakeDone:     func(_ tls.ConnectionState, _ error) { t6 = time.Now() },
+	}
+	// failedPhase is the phase the request was in when it failed
+	failedPhase := func() string {
+		switch {
+		case !t0.IsZero() && t1.IsZero():
+			return PhaseDNS
+		case t3.IsZero() && !t5.IsZero():
+			return PhaseTLS
+		case t3.IsZero():
+			return PhaseConnect
+		default:
+			return PhaseResponse
 		}
+	}
 
-		client := &http.Client{
-			Transport: t,
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				// always refuse to follow redirects, visit does that
-				// manually if required.
-				return http.ErrUseLastResponse
-			},
+	var counter *countingReader
+	if req.Body != nil {
+		counter = &countingReader{r: req.Body, w: w, progress: progressRecorder{interval: s.ProgressInterval}}
+		req.Body = io.NopCloser(counter)
+	}
+	defer func() {
+		if counter != nil {
+			counter.finish()
 		}
-		resp, err := client.Do(req)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "request failed "+err.Error())
+	}()
+
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+	req.Header.Set("User-Agent", userAgent)
+	if client == nil {
+		var t *http.Transport
+		client, t = s.newClient(target, req.Host, certificates)
+		defer t.CloseIdleConnections()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		x := Sample{Phase: failedPhase(), Err: err}
+		if counter != nil {
+			x.Bytes = counter.n.Load()
 		}
-		// bodyMsg := readResponseBody(req, resp)
-		// if bodyMsg != "" {
-		// 	fmt.Printf("Download \n%s\n", bodyMsg)
-		// }
-		body, err := io.ReadAll(resp.Body)
-
-		resp.Body.Close()
+		return x
+	}
+	// bodies may be large or endless load, never keep them
+	if counter == nil {
+		counter = &countingReader{r: resp.Body, w: w, progress: progressRecorder{interval: s.ProgressInterval}}
+		_, err = io.Copy(io.Discard, counter)
+	} else {
+		_, err = io.Copy(io.Discard, resp.Body)
+	}
+	resp.Body.Close()
+	if counter != nil {
+		counter.finish()
+		if resp.StatusCode != 200 {
+			// an error response is no throughput
+			counter.reject()
+		}
+	}
 
-		t7 := time.Now() // after read body
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error reading body "+strconv.Itoa(len(body))+" "+err.Error())
+	t7 := time.Now() // after read body
+	if err != nil {
+		phase := PhaseBody
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// the body ended before its Content-Length
+			phase = PhaseIntegrity
 		}
-		if resp.StatusCode == 200 {
-			//fmt.Printf("download %v\n", resp.Status)
-			if t0.IsZero() {
-				// we skipped DNS
-				t0 = t1
-			}
+		return Sample{Phase: phase, Status: resp.StatusCode, Bytes: counter.n.Load(), Err: fmt.Errorf("error reading body: %v", err)}
+	}
+	if resp.StatusCode != 200 {
+		return Sample{Phase: PhaseStatus, Status: resp.StatusCode, Err: fmt.Errorf("%s %s: unexpected status %s", req.Method, target, resp.Status)}
+	}
 
-			//fmt.Println(t0.UnixMilli(), t1.UnixMilli(), t2.UnixMilli(), t3.UnixMilli(), t4.UnixMilli(), t7.UnixMilli())
-			//fmt.Printf("t4: %v, t7: %v, sub: %v\n", t4, t7, t7.Sub(t4))
-			switch download_url.Scheme {
-			case "https":
-				_ = t6.Sub(t5)                          // tls handshake
-				_ = t2.Sub(t0)                          // connect
-				dnstimes = append(dnstimes, t1.Sub(t0)) // dns lookup
-				tcptimes = append(tcptimes, t3.Sub(t1))
-				servertimes = append(servertimes, t4.Sub(t3))     // server processing
-				fulltimes = append(fulltimes, t7.Sub(t0))         // total
-				transfertimes = append(transfertimes, t7.Sub(t4)) // GET content transfer starts after server responds
-
-				// t1.Sub(t0) // namelookup
-				// t2.Sub(t0) // connect
-				// 	t4.Sub(t0) // starttransfer
-			case "http":
-				_ = t3.Sub(t1)                                    // tcp connection
-				_ = t2.Sub(t0)                                    // connected
-				dnstimes = append(dnstimes, t1.Sub(t0))           // dns lookup
-				tcptimes = append(tcptimes, t3.Sub(t1))           // tcp connection
-				servertimes = append(servertimes, t4.Sub(t3))     // server processing
-				fulltimes = append(fulltimes, t7.Sub(t0))         // total
-				transfertimes = append(transfertimes, t7.Sub(t4)) // GET content transfer starts after server responds
-
-				// t1.Sub(t0) // namelookup
-				// t2.Sub(t0) // connection complete
-				// 	t4.Sub(t0) // starttransfer
+	if t1.IsZero() {
+		// we reused a connection
+		t1, t2 = t3, t3
+	}
+	if t0.IsZero() {
+		// we skipped DNS
+		t0 = t1
+	}
 
-			}
+	transfer_start, transfer_end := t4, t7 // GET content transfer starts after server responds
+	if req.Method == "POST" {
+		// POST content transfer runs from the first byte written until the
+		// body is written and the server has responded
+		transfer_start, transfer_end = t3, t4
+		if counter != nil && !counter.first().IsZero() {
+			transfer_start = counter.first()
+		}
+		wroteMu.Lock()
+		if wrote.After(transfer_end) {
+			transfer_end = wrote
+		}
+		wroteMu.Unlock()
+	}
+	x = Sample{
+		DNS:      t1.Sub(t0), // dns lookup
+		Connect:  t2.Sub(t1), // tcp handshake
+		TCP:      t3.Sub(t1), // tcp connection
+		TLS:      t6.Sub(t5), // tls handshake
+		Server:   t4.Sub(t3), // server processing
+		TTFB:     t4.Sub(t0), // time to first byte
+		Full:     t7.Sub(t0), // total
+		Transfer: transfer_end.Sub(transfer_start),
+		Status:   resp.StatusCode,
+		Proto:    resp.Proto,
+		Reused:   conn.Reused,
+		WasIdle:  conn.WasIdle,
+		IdleTime: conn.IdleTime,
+	}
+	x.RawTransfer = x.Transfer
+	if d, ok := parseServerTiming(resp.Header.Values("Server-Timing")); ok {
+		// take the server's own processing time out of our measurements
+		x.ServerTiming = d
+		if req.Method == "POST" {
+			x.Transfer = max(x.RawTransfer-d, 0)
 		} else {
-			fmt.Fprintf(os.Stderr, download_url.String()+" "+strconv.Itoa(resp.StatusCode))
+			x.RTT = max(x.Server-d, 0)
 		}
-
 	}
-	return fulltimes, servertimes, tcptimes, dnstimes, transfertimes
+	if resp.TLS != nil {
+		x.TLSVersion = tls.VersionName(resp.TLS.Version)
+		x.CipherSuite = tls.CipherSuiteName(resp.TLS.CipherSuite)
+		x.ALPN = resp.TLS.NegotiatedProtocol
+	}
+	if counter != nil {
+		x.Bytes = counter.n.Load()
+		x.Progress = counter.progress.series()
+		x.SteadyBitsPerSecond = steadyBitsPerSecond(x.Progress)
+	}
+	return x
 }
 
-// runs upload tests
-func (s *Speedtest) Upload(numbytes int, iterations int) ([]time.Duration, []time.Duration, []time.Duration, []time.Duration, []time.Duration) {
-	var fulltimes []time.Duration
-	var servertimes []time.Duration
-	var dnstimes []time.Duration
-	var tcptimes []time.Duration
-	var transfertimes []time.Duration
-	thedata := make([]byte, numbytes)
-
-	upload_url := parseURL("http://speed.cloudflare.com/__up")
+// RunAllTests measures idle latency, then runs every download and upload test
+// over a single address family. Failed iterations are recorded in the result
+// and do not stop the run; an error is only returned if a test could not be
+// started, together with the results measured up to that point. If none of
+// the latency probes can connect, the result is marked unreachable and the
+// error wraps ErrUnreachable.
+//
+// RunAllTests stops as soon as ctx is done or RunTimeout has passed.
+func (s *Speedtest) RunAllTests(ctx context.Context) (*Result, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	if s.Family == FamilyBoth {
+		return nil, fmt.Errorf("RunAllTests measures a single address family, use RunFamilies for %q", FamilyBoth)
+	}
+	if s.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.RunTimeout)
+		defer cancel()
+	}
 
-	for i := 0; i < iterations; i++ {
-		data := url.Values{}
-		data.Set("data", string(thedata))
-		req, _ := http.NewRequest("POST", upload_url.String(), strings.NewReader(data.Encode()))
-
-		var t0, t1, t2, t3, t4, t5, t6 time.Time
-		trace := &httptrace.ClientTrace{
-			DNSStart: func(_ httptrace.DNSStartInfo) { t0 = time.Now() },
-			DNSDone:  func(_ httptrace.DNSDoneInfo) { t1 = time.Now() },
-			ConnectStart: func(_, _ string) {
-				if t1.IsZero() {
-					// connecting to IP
-					t1 = time.Now()
-				}
-			},
-			ConnectDone: func(net, addr string, err error) {
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "unable to connect to host "+addr+" "+err.Error())
-				}
-				t2 = time.Now()
-				//printf("\n%s%s\n", color.GreenString("Connected to "), color.CyanString(addr))
-			},
-			GotConn:              func(_ httptrace.GotConnInfo) { t3 = time.Now() },
-			GotFirstResponseByte: func() { t4 = time.Now() },
-			TLSHandshakeStart:    func() { t5 = time.Now() },
-			TLSHandshakeDone:     func(_ tls.ConnectionState, _ error) { t6 = time.Now() },
-		}
-		req = req.WithContext(httptrace.WithClientTrace(context.Background(), trace))
-
-		req.Header.Set("User-Agent", userAgent)
-		t := &http.Transport{
-			Proxy:                 http.ProxyFromEnvironment,
-			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-			ForceAttemptHTTP2:     true,
-		}
-		t.DialContext = dialContext("tcp4")
-		switch upload_url.Scheme {
-		case "https":
-			host, _, err := net.SplitHostPort(req.Host)
-			if err != nil {
-				host = req.Host
-			}
+	r := &Result{
+		Start:         time.Now(),
+		Target:        s.BaseURL,
+		Family:        s.family(),
+		LatencyReps:   s.LatencyReps,
+		DownloadTests: s.DownloadTests,
+		UploadTests:   s.UploadTests,
+		Adaptive:      s.Adaptive != nil,
+	}
+	defer r.finish(s.bandwidthMinDuration())
 
-			t.TLSClientConfig = &tls.Config{
-				ServerName:         host,
-				InsecureSkipVerify: insecure,
-				Certificates:       readClientCert(clientCertFile),
-				MinVersion:         tls.VersionTLS12,
-			}
-		}
+	latency_samples, err := s.Latency(ctx, s.LatencyReps)
+	r.setLatency(latency_samples)
+	if err != nil {
+		return r, fmt.Errorf("latency: %v", err)
+	}
+	if reason := unreachable(latency_samples); reason != nil {
+		r.Unreachable = reason.Error()
+		return r, fmt.Errorf("%s: %w: %v", r.Family, ErrUnreachable, reason)
+	}
 
-		client := &http.Client{
-			Transport: t,
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				// always refuse to follow redirects, visit does that
-				// manually if required.
-				return http.ErrUseLastResponse
-			},
-		}
-		resp, err := client.Do(req)
+	if r.Adaptive {
+		capped, cancel := s.adaptiveDeadline(ctx)
+		defer cancel()
+		r.Download, err = s.adaptive(ctx, capped, s.DownloadTests, s.download)
 		if err != nil {
-			log.Printf("failed to read response: %v\n", err)
+			return r, fmt.Errorf("download %v", err)
 		}
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		t7 := time.Now() // after read body
+		r.Upload, err = s.adaptive(ctx, capped, s.UploadTests, s.upload)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "error reading body "+strconv.Itoa(len(body))+" "+err.Error())
+			return r, fmt.Errorf("upload %v", err)
 		}
-		if resp.StatusCode == 200 {
-			if t0.IsZero() {
-				// we skipped DNS
-				t0 = t1
+	} else {
+		for _, test := range s.DownloadTests {
+			samples, err := s.download(ctx, test.NumBytes, test.Iterations, test.Streams)
+			r.Download = append(r.Download, newTestResult(test, samples))
+			if err != nil {
+				return r, fmt.Errorf("download %s: %v", test.Name, err)
 			}
-			//fmt.Println(t0.UnixMilli(), t1.UnixMilli(), t2.UnixMilli(), t3.UnixMilli(), t4.UnixMilli(), t7.UnixMilli())
-
-			switch upload_url.Scheme {
-			case "https":
-				_ = t6.Sub(t5)                          // tls handshake
-				_ = t2.Sub(t0)                          // connect
-				dnstimes = append(dnstimes, t1.Sub(t0)) // dns lookup
-				tcptimes = append(tcptimes, t3.Sub(t1))
-				servertimes = append(servertimes, t4.Sub(t3))     // server processing
-				fulltimes = append(fulltimes, t7.Sub(t0))         // total
-				transfertimes = append(transfertimes, t7.Sub(t3)) // POST content transfer starts when connection completes
-
-				// t1.Sub(t0) // namelookup
-				// t2.Sub(t0) // connect
-				// 	t4.Sub(t0) // starttransfer
-			case "http":
-				_ = t3.Sub(t1)                                    // tcp connection
-				_ = t2.Sub(t0)                                    // connected
-				dnstimes = append(dnstimes, t1.Sub(t0))           // dns lookup
-				tcptimes = append(tcptimes, t3.Sub(t1))           // tcp connection
-				servertimes = append(servertimes, t4.Sub(t3))     // server processing
-				fulltimes = append(fulltimes, t7.Sub(t0))         // total
-				transfertimes = append(transfertimes, t7.Sub(t3)) // POST content transfer starts when connection completes
-
-				// t1.Sub(t0) // namelookup
-				// t2.Sub(t0) // connection complete
-				// 	t4.Sub(t0) // starttransfer
+		}
 
+		for _, test := range s.UploadTests {
+			samples, err := s.upload(ctx, test.NumBytes, test.Iterations, test.Streams)
+			r.Upload = append(r.Upload, newTestResult(test, samples))
+			if err != nil {
+				return r, fmt.Errorf("upload %s: %v", test.Name, err)
 			}
-		} else {
-			fmt.Fprintf(os.Stderr, upload_url.String()+" "+strconv.Itoa(resp.StatusCode))
 		}
-
 	}
-	return fulltimes, servertimes, tcptimes, dnstimes, transfertimes
-}
-
-func (s *Speedtest) RunAllTests() {
 
-	fmt.Printf("cf_start_timestamp %v\n", start_timestamp)
-	_, _, tcptimes, dnstimes, _ := s.Download(0, latencyreps)
+	if s.LoadDuration > 0 {
+		for _, direction := range []string{"download", "upload"} {
+			loaded, err := s.LoadedLatency(ctx, direction)
+			if loaded != nil {
+				r.addLoadedLatency(*loaded)
+			}
+			if err != nil {
+				return r, fmt.Errorf("latency under %s load: %v", direction, err)
+			}
+		}
+	}
 
-	calc_tcp_jitter := timeCalculations.CalculateCorrectedDeviation(tcptimes)
-	avg_latency := timeCalculations.CalculateAverageDuration(tcptimes)
-	avg_dnstime := timeCalculations.CalculateAverageDuration(dnstimes)
-	fmt.Printf("cf_latency_ms %.2f\n", avg_latency/1e6)
-	fmt.Printf("cf_tcp_jitter_ms %.2f\n", calc_tcp_jitter/1e6)
-	fmt.Printf("cf_dnslookup_ms %.2f\n", avg_dnstime/1e6)
+	return r, nil
+}
 
-	download_results := make([]float64, 0)
-	upload_results := make([]float64, 0)
+// bandwidthMinDuration is the shortest transfer that counts towards the
+// aggregate bandwidth: the minimum duration of adaptive runs, otherwise the
+// 10ms of speed.cloudflare.com.
+func (s *Speedtest) bandwidthMinDuration() time.Duration {
+	if s.Adaptive != nil {
+		return s.Adaptive.MinDuration
+	}
+	return 10 * time.Millisecond
+}
 
-	for t := 0; t < len(s.DownloadTests); t++ {
-		downfulltimes, _, downtcptimes, _, downtransfertimes := s.Download(s.DownloadTests[t].NumBytes, s.DownloadTests[t].Iterations)
-		down_tcp_jitter := timeCalculations.CalculateCorrectedDeviation(downtcptimes)
-		avg_downtransfer := timeCalculations.CalculateAverageDurationSeconds(downtransfertimes)
-		//fmt.Printf("download %v\n", avg_downtransfer)
-		downspeed := (float64(s.DownloadTests[t].NumBytes*8) / avg_downtransfer) / 1e6
-		down_latency := timeCalculations.CalculateAverageDuration(downfulltimes)
-		fmt.Printf("cf_%v_download_latency_ms %.2f\n", s.DownloadTests[t].Name, down_latency/1e6)
-		fmt.Printf("cf_%v_download_Mbps %.2f\n", s.DownloadTests[t].Name, downspeed)
-		fmt.Printf("cf_%v_download_tcp_jitter %.2f\n", s.DownloadTests[t].Name, down_tcp_jitter/1e6)
-		download_results = append(download_results, downspeed)
+// RunFamilies runs the plan once for every address family selected by
+// Family and returns one result per family. In FamilyBoth mode an
+// unreachable family is reported in its result and only causes an error if
+// no family is reachable. RunTimeout applies to each family separately.
+func (s *Speedtest) RunFamilies(ctx context.Context) ([]*Result, error) {
+	families := []string{s.family()}
+	if s.Family == FamilyBoth {
+		families = []string{FamilyIPv4, FamilyIPv6}
 	}
-	down_per, _ := stats.Percentile(download_results, 90.0)
-	fmt.Printf("cf_90th_percentile_download_speed %.2f\n", down_per)
 
-	for t := 0; t < len(s.UploadTests); t++ {
-		upfulltimes, _, uptcptimes, _, uptransfertimes := s.Upload(s.UploadTests[t].NumBytes, s.UploadTests[t].Iterations)
-		up_tcp_jitter := timeCalculations.CalculateCorrectedDeviation(uptcptimes)
-		avg_uptransfer := timeCalculations.CalculateAverageDurationSeconds(uptransfertimes)
-		//fmt.Printf("upload %v s\n", avg_uptransfer)
-		upspeed := (float64(s.UploadTests[t].NumBytes*8) / avg_uptransfer) / 1e6
-		up_latency := timeCalculations.CalculateAverageDuration(upfulltimes)
-		fmt.Printf("cf_%v_upload_latency_ms %.2f\n", s.UploadTests[t].Name, up_latency/1e6)
-		fmt.Printf("cf_%v_upload_Mbps %.2f\n", s.UploadTests[t].Name, upspeed)
-		fmt.Printf("cf_%v_upload_tcp_jitter %.2f\n", s.UploadTests[t].Name, up_tcp_jitter/1e6)
-		upload_results = append(upload_results, upspeed)
+	var results []*Result
+	reachable := 0
+	for _, family := range families {
+		single := *s
+		single.Family = family
+		r, err := single.RunAllTests(ctx)
+		if r != nil {
+			results = append(results, r)
+		}
+		switch {
+		case err == nil:
+			reachable++
+		case errors.Is(err, ErrUnreachable) && len(families) > 1:
+		default:
+			return results, err
+		}
+	}
+	if reachable == 0 {
+		return results, fmt.Errorf("%w over %s", ErrUnreachable, strings.Join(families, " and "))
 	}
-	up_per, _ := stats.Percentile(upload_results, 90.0)
-	fmt.Printf("cf_90th_percentile_upload_speed %.2f\n", up_per)
+	return results, nil
+}
 
+// unreachable returns the error of the first probe if every latency probe
+// failed before a connection was made.
+func unreachable(samples []Sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	for _, x := range samples {
+		if x.OK() || (x.Phase != PhaseDNS && x.Phase != PhaseConnect) {
+			return nil
+		}
+	}
+	return samples[0].Err
 }
@@ -0,0 +1,32 @@
+package speedtest
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckBytes(t *testing.T) {
+	failed := Sample{Phase: PhaseStatus, Status: 500, Err: errors.New("unexpected status")}
+	for _, tc := range []struct {
+		name  string
+		x     Sample
+		want  int
+		phase string
+		ok    bool
+	}{
+		{"complete", Sample{Status: 200, Bytes: 1000}, 1000, "", true},
+		{"short", Sample{Status: 200, Bytes: 999}, 1000, PhaseIntegrity, false},
+		{"long", Sample{Status: 200, Bytes: 1001}, 1000, PhaseIntegrity, false},
+		{"unchecked", Sample{Status: 200, Bytes: 10}, -1, "", true},
+		{"empty", Sample{Status: 200}, 0, "", true},
+		{"failed", failed, 1000, PhaseStatus, false},
+	} {
+		got := checkBytes(tc.x, tc.want)
+		if got.OK() != tc.ok || got.Phase != tc.phase {
+			t.Errorf("%s: got ok %v, phase %q, want %v, %q", tc.name, got.OK(), got.Phase, tc.ok, tc.phase)
+		}
+		if got.Bytes != tc.x.Bytes || got.Status != tc.x.Status {
+			t.Errorf("%s: got %d bytes, status %d, want %d, %d", tc.name, got.Bytes, got.Status, tc.x.Bytes, tc.x.Status)
+		}
+	}
+}
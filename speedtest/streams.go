@@ -0,0 +1,228 @@
+package speedtest
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cfspeedtest/stats"
+)
+
+// streamWindow counts the bytes moved by the concurrent streams of one
+// iteration and finds the interval in which all of them were transferring.
+type streamWindow struct {
+	streams int
+	bytes   atomic.Int64
+	started atomic.Int32
+
+	mu sync.Mutex
+	// first and last are the start of the first and the end of the last
+	// transfer, start and end the overlap of all transfers.
+	first, start, end, last time.Time
+	startBytes, endBytes    int64
+}
+
+// begin is called when a stream moves its first byte.
+func (w *streamWindow) begin() {
+	now := time.Now()
+	n := int(w.started.Add(1))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.first.IsZero() {
+		w.first = now
+	}
+	if n == w.streams {
+		w.start = now
+		w.startBytes = w.bytes.Load()
+	}
+}
+
+// finish is called when a stream has moved its last byte or failed.
+func (w *streamWindow) finish() {
+	now := time.Now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.end.IsZero() {
+		w.end = now
+		w.endBytes = w.bytes.Load()
+	}
+	w.last = now
+}
+
+// overlap returns the bytes moved while all streams were transferring and
+// the length of that interval. If the streams never all ran at once, it
+// falls back to the bytes and duration of the whole transfer.
+func (w *streamWindow) overlap() (int64, time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.start.IsZero() && w.end.After(w.start) {
+		return w.endBytes - w.startBytes, w.end.Sub(w.start)
+	}
+	return w.bytes.Load(), w.last.Sub(w.first)
+}
+
+// total returns all bytes moved and the time from the first to the last transfer.
+func (w *streamWindow) total() (int64, time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.bytes.Load(), w.last.Sub(w.first)
+}
+
+// countingReader counts the bytes read from a body, notes when the first of
+// them was read and records the progress from then on; with w set, the body is one stream and its bytes
+// are counted into the window as well. A request body may still be read by
+// the transport while the request fails, so it is safe for concurrent use
+// with finish and reject.
+type countingReader struct {
+	r        io.Reader
+	w        *streamWindow
+	n        atomic.Int64
+	start    time.Time
+	progress progressRecorder
+	started  sync.Once
+	finished sync.Once
+
+	// windowed is the part of n counted into w
+	mu       sync.Mutex
+	windowed int64
+	rejected bool
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.started.Do(c.begin)
+		c.n.Add(int64(n))
+		if c.w != nil {
+			c.mu.Lock()
+			if !c.rejected {
+				c.w.bytes.Add(int64(n))
+				c.windowed += int64(n)
+			}
+			c.mu.Unlock()
+		}
+	}
+	if err == io.EOF {
+		c.finish()
+	}
+	return n, err
+}
+
+func (c *countingReader) begin() {
+	c.start = time.Now()
+	c.progress.start(&c.n)
+	if c.w != nil {
+		c.w.begin()
+	}
+}
+
+// first returns the time the first byte was read, zero if none was. It
+// must not be called before the body is done.
+func (c *countingReader) first() time.Time {
+	c.started.Do(func() {}) // synchronizes with begin
+	return c.start
+}
+
+// reject takes the bytes of a transfer the server refused back out of the
+// window and stops counting further ones into it.
+func (c *countingReader) reject() {
+	if c.w == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.rejected {
+		c.rejected = true
+		c.w.bytes.Add(-c.windowed)
+	}
+}
+
+// finish ends the transfer of the stream; only the first call counts.
+func (c *countingReader) finish() {
+	c.finished.Do(func() {
+		c.progress.finish()
+		if c.w != nil {
+			c.w.finish()
+		}
+	})
+}
+
+// streams runs one iteration as n concurrent requests of numbytes each, each
+// on its own connection, and combines them into a single sample. Its Transfer and
+// Bytes cover the interval in which all streams were transferring.
+func (s *Speedtest) streams(ctx context.Context, target *url.URL, certificates []tls.Certificate, n, numbytes int, newReq func() (*http.Request, error)) Sample {
+	w := &streamWindow{streams: n}
+	samples := make([]Sample, n)
+	var wg sync.WaitGroup
+	for i := range samples {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			samples[i] = checkBytes(s.iteration(ctx, target, certificates, nil, newReq, w), numbytes)
+			samples[i].Iteration = i
+		}(i)
+	}
+	wg.Wait()
+
+	x := Sample{Streams: samples}
+	for _, st := range samples {
+		if !st.OK() {
+			x.Phase, x.Status, x.TimedOut = st.Phase, st.Status, st.TimedOut
+			x.Err = fmt.Errorf("stream %d: %v", st.Iteration, st.Err)
+			return x
+		}
+	}
+
+	x.Bytes, x.Transfer = w.overlap()
+	x.RawTransfer = x.Transfer
+	x.DNS = averageDuration(samples, func(st Sample) time.Duration { return st.DNS })
+	x.Connect = averageDuration(samples, func(st Sample) time.Duration { return st.Connect })
+	x.TCP = averageDuration(samples, func(st Sample) time.Duration { return st.TCP })
+	x.TLS = averageDuration(samples, func(st Sample) time.Duration { return st.TLS })
+	x.Server = averageDuration(samples, func(st Sample) time.Duration { return st.Server })
+	x.ServerTiming = averageDuration(samples, func(st Sample) time.Duration { return st.ServerTiming })
+	x.RTT = averageDuration(samples, func(st Sample) time.Duration { return st.RTT })
+	for _, st := range samples {
+		x.SteadyBitsPerSecond += st.SteadyBitsPerSecond
+	}
+	for _, st := range samples {
+		if st.Full > x.Full {
+			x.Full = st.Full
+		}
+	}
+	x.Status = samples[0].Status
+	x.Proto, x.TLSVersion, x.CipherSuite, x.ALPN = samples[0].Proto, samples[0].TLSVersion, samples[0].CipherSuite, samples[0].ALPN
+
+	throughput := make([]float64, 0, n)
+	for _, st := range samples {
+		throughput = append(throughput, bitsPerSecond(st.Bytes, st.Transfer))
+	}
+	// the index is undefined if no stream moved a byte
+	if fairness, err := stats.JainsIndex(throughput); err == nil {
+		x.Fairness = fairness
+	}
+	return x
+}
+
+// averageDuration is the mean of one duration picked out of every sample.
+func averageDuration(samples []Sample, pick func(Sample) time.Duration) time.Duration {
+	var sum time.Duration
+	for _, x := range samples {
+		sum += pick(x)
+	}
+	return sum / time.Duration(len(samples))
+}
+
+// bitsPerSecond is the throughput of moving n bytes in d, or 0 if d is not positive.
+func bitsPerSecond(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n*8) / d.Seconds()
+}
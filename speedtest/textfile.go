@@ -0,0 +1,122 @@
+package speedtest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// statusMetrics are rewritten on every run, all other metrics only on success.
+var statusMetrics = []string{"cf_last_run_success", "cf_last_run_timestamp_seconds"}
+
+// WriteTextfile writes results to path for node_exporter's textfile collector.
+// runErr is the error returned by the run. If it is set, the metrics of the
+// previous successful run are kept and only cf_last_run_success and
+// cf_last_run_timestamp_seconds are updated.
+//
+// The file is written to a temporary file in the same directory and renamed
+// into place, so the collector never sees a partially written file.
+func WriteTextfile(path string, labels map[string]string, runErr error, results ...*Result) error {
+	p, err := newPromWriter(labels)
+	if err != nil {
+		return err
+	}
+	success := 1.0
+	if runErr != nil {
+		success = 0
+	}
+	p.add("cf_last_run_success", "gauge", "Whether the last speedtest run succeeded.", success)
+	p.add("cf_last_run_timestamp_seconds", "gauge", "Unix time of the last speedtest run.", float64(time.Now().UnixNano())/1e9)
+
+	var b bytes.Buffer
+	if err := p.write(&b); err != nil {
+		return err
+	}
+
+	if runErr == nil {
+		metrics, err := newPromWriter(labels)
+		if err != nil {
+			return err
+		}
+		for _, r := range results {
+			metrics.addResult(r)
+		}
+		if err := metrics.write(&b); err != nil {
+			return err
+		}
+	} else {
+		previous, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		b.Write(withoutMetrics(previous, statusMetrics))
+	}
+
+	return writeFileAtomic(path, b.Bytes())
+}
+
+// withoutMetrics drops the samples and metadata of the named metrics from an exposition.
+func withoutMetrics(exposition []byte, names []string) []byte {
+	var out bytes.Buffer
+	sc := bufio.NewScanner(bytes.NewReader(exposition))
+	sc.Buffer(nil, 1<<20)
+lines:
+	for sc.Scan() {
+		line := sc.Text()
+		for _, name := range names {
+			if metricName(line) == name {
+				continue lines
+			}
+		}
+		out.WriteString(line + "\n")
+	}
+	return out.Bytes()
+}
+
+// metricName returns the metric a line of the exposition format belongs to.
+func metricName(line string) string {
+	if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+		line = line[len("# HELP "):]
+	}
+	if i := strings.IndexAny(line, "{ "); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+// writeFileAtomic replaces path with data, so readers see either the old or the new content.
+func writeFileAtomic(path string, data []byte) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	// the temporary name must not end in .prom, or node_exporter may pick it up
+	f, err := os.CreateTemp(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,75 @@
+package speedtest
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTextfileKeepsPreviousRun(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cf.prom")
+	labels := map[string]string{"site": "ams"}
+	r := &Result{
+		Start:       time.Unix(1700000000, 0),
+		Target:      "http://example.com",
+		Family:      FamilyIPv4,
+		Latency:     12 * time.Millisecond,
+		LatencyReps: 1,
+	}
+
+	if err := WriteTextfile(path, labels, nil, r); err != nil {
+		t.Fatalf("WriteTextfile: %v", err)
+	}
+	first, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(first), `cf_last_run_success{site="ams"} 1`) {
+		t.Fatalf("successful run not marked in\n%s", first)
+	}
+
+	if err := WriteTextfile(path, labels, errors.New("unreachable")); err != nil {
+		t.Fatalf("WriteTextfile: %v", err)
+	}
+	second, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(second), `cf_last_run_success{site="ams"} 0`) {
+		t.Errorf("failed run not marked in\n%s", second)
+	}
+	if strings.Count(string(second), "cf_last_run_success{") != 1 || strings.Count(string(second), "# TYPE cf_last_run_timestamp_seconds") != 1 {
+		t.Errorf("status metrics repeated in\n%s", second)
+	}
+	// everything but the status metrics is kept from the successful run
+	kept := string(withoutMetrics(first, statusMetrics))
+	if kept == "" || !strings.HasSuffix(string(second), kept) {
+		t.Errorf("metrics of the previous run not kept:\n%s", second)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+}
+
+func TestWriteTextfileWithoutPreviousRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cf.prom")
+	if err := WriteTextfile(path, nil, errors.New("unreachable")); err != nil {
+		t.Fatalf("WriteTextfile: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "cf_last_run_success 0") || strings.Contains(string(data), "cf_latency") {
+		t.Errorf("unexpected metrics:\n%s", data)
+	}
+}
@@ -0,0 +1,28 @@
+package stats
+
+import "math"
+
+// JainsIndex gets Jain's fairness index of a slice of allocations, such as
+// the throughput of concurrent flows. It is 1 if all values are equal and
+// 1/n if a single value takes everything.
+func JainsIndex(input []float64) (float64, error) {
+
+	if len(input) == 0 {
+		return math.NaN(), EmptyInputErr
+	}
+
+	var sum, squares float64
+	for _, n := range input {
+		if n < 0 {
+			return math.NaN(), NegativeErr
+		}
+		sum += n
+		squares += n * n
+	}
+
+	if squares == 0 {
+		return math.NaN(), ZeroErr
+	}
+
+	return sum * sum / (float64(len(input)) * squares), nil
+}
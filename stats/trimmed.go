@@ -0,0 +1,22 @@
+package stats
+
+import "math"
+
+// TrimmedMean gets the mean of the lowest percent of a slice of numbers,
+// dropping the largest values as outliers
+func TrimmedMean(input []float64, percent float64) (float64, error) {
+
+	if len(input) == 0 {
+		return math.NaN(), EmptyInputErr
+	}
+
+	if percent <= 0 || percent > 100 {
+		return math.NaN(), BoundsErr
+	}
+
+	// Rounding up keeps at least one value
+	c := sortedCopy(input)
+	keep := int(math.Ceil(percent / 100 * float64(len(c))))
+
+	return Mean(c[:keep])
+}
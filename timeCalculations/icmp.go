@@ -0,0 +1,128 @@
+package timeCalculations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// ICMP message types of echo requests and replies.
+const (
+	icmpv4EchoRequest = 8
+	icmpv4EchoReply   = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+// ICMPProber measures the round trip of an ICMP echo to Host, like ping.
+// Unless Privileged is set it uses an unprivileged datagram socket, which is
+// only available on Linux to the groups in net.ipv4.ping_group_range;
+// privileged probes need a raw socket and thus root.
+type ICMPProber struct {
+	Host       string
+	Privileged bool
+
+	seq uint16
+}
+
+func NewICMPProber(host string, privileged bool) *ICMPProber {
+	return &ICMPProber{Host: host, Privileged: privileged}
+}
+
+// Probe sends one echo request and waits for its reply until ctx is done.
+// The host is resolved before the clock starts.
+func (p *ICMPProber) Probe(ctx context.Context) (time.Duration, error) {
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, p.Host)
+	if err != nil {
+		return 0, err
+	}
+	ip := ips[0].IP
+	ipv6 := ip.To4() == nil
+
+	var conn net.PacketConn
+	var dst net.Addr
+	switch {
+	case p.Privileged && ipv6:
+		conn, err = net.ListenPacket("ip6:ipv6-icmp", "::")
+		dst = &net.IPAddr{IP: ip, Zone: ips[0].Zone}
+	case p.Privileged:
+		conn, err = net.ListenPacket("ip4:icmp", "0.0.0.0")
+		dst = &net.IPAddr{IP: ip}
+	default:
+		conn, err = listenICMPDatagram(ipv6)
+		dst = &net.UDPAddr{IP: ip, Zone: ips[0].Zone}
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// unblock the read below if ctx is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	p.seq++
+	// datagram sockets replace the id with their own and only receive their replies
+	id := uint16(os.Getpid())
+	request, reply := byte(icmpv4EchoRequest), byte(icmpv4EchoReply)
+	if ipv6 {
+		request, reply = icmpv6EchoRequest, icmpv6EchoReply
+	}
+	msg := []byte{request, 0, 0, 0, byte(id >> 8), byte(id), byte(p.seq >> 8), byte(p.seq)}
+	msg = append(msg, "cfspeedtest jitter"...)
+	if !ipv6 {
+		// the kernel computes the checksum of ICMPv6
+		sum := icmpChecksum(msg)
+		msg[2], msg[3] = byte(sum>>8), byte(sum)
+	}
+
+	start := time.Now()
+	if _, err := conn.WriteTo(msg, dst); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return 0, fmt.Errorf("no echo reply from %s", p.Host)
+			}
+			return 0, err
+		}
+		rtt := time.Since(start)
+		if n < 8 || buf[0] != reply {
+			continue
+		}
+		if uint16(buf[6])<<8|uint16(buf[7]) != p.seq {
+			continue
+		}
+		if p.Privileged && uint16(buf[4])<<8|uint16(buf[5]) != id {
+			// raw sockets see the replies to every process
+			continue
+		}
+		return rtt, nil
+	}
+}
+
+// icmpChecksum is the internet checksum of msg.
+func icmpChecksum(msg []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(msg); i += 2 {
+		sum += uint32(msg[i])<<8 | uint32(msg[i+1])
+	}
+	if len(msg)%2 == 1 {
+		sum += uint32(msg[len(msg)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
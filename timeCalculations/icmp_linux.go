@@ -0,0 +1,32 @@
+//go:build linux
+
+package timeCalculations
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenICMPDatagram opens an unprivileged ICMP socket, which the kernel
+// only allows to the groups in net.ipv4.ping_group_range.
+func listenICMPDatagram(ipv6 bool) (net.PacketConn, error) {
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	var addr syscall.Sockaddr = &syscall.SockaddrInet4{}
+	if ipv6 {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+		addr = &syscall.SockaddrInet6{}
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, fmt.Errorf("unprivileged icmp socket: %v (is the group allowed by net.ipv4.ping_group_range?)", err)
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("unprivileged icmp socket: %v", err)
+	}
+	f := os.NewFile(uintptr(fd), "icmp")
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
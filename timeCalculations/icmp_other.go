@@ -0,0 +1,14 @@
+//go:build !linux
+
+package timeCalculations
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// listenICMPDatagram fails, unprivileged ICMP sockets are only supported on Linux.
+func listenICMPDatagram(ipv6 bool) (net.PacketConn, error) {
+	return nil, fmt.Errorf("unprivileged icmp is not supported on %s, use a privileged prober", runtime.GOOS)
+}
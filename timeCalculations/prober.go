@@ -0,0 +1,105 @@
+package timeCalculations
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Prober measures a single round trip to a host.
+type Prober interface {
+	Probe(ctx context.Context) (time.Duration, error)
+}
+
+// TCPProber measures the time to establish a tcp connection to Address, a host:port pair.
+type TCPProber struct {
+	Address string
+	Dialer  net.Dialer
+}
+
+func NewTCPProber(address string) *TCPProber {
+	return &TCPProber{Address: address}
+}
+
+// Probe connects and closes the connection again; the handshake takes one round trip.
+// The host is resolved before the clock starts.
+func (p *TCPProber) Probe(ctx context.Context) (time.Duration, error) {
+	host, port, err := net.SplitHostPort(p.Address)
+	if err != nil {
+		return 0, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return 0, err
+	}
+	address := net.JoinHostPort(ips[0].String(), port)
+
+	start := time.Now()
+	conn, err := p.Dialer.DialContext(ctx, "tcp", address)
+	rtt := time.Since(start)
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+	return rtt, nil
+}
+
+// HTTPProber measures the time from sending a request to URL until the
+// first byte of the response, on a connection kept open between probes.
+type HTTPProber struct {
+	URL string
+	// Method is HEAD if empty.
+	Method string
+	Client *http.Client
+}
+
+func NewHTTPProber(url string) *HTTPProber {
+	return &HTTPProber{URL: url, Method: http.MethodHead, Client: &http.Client{}}
+}
+
+// Probe sends one request. The round trip includes the time the server
+// takes to respond; the first probe also sets up the connection, but that
+// is not part of its round trip.
+func (p *HTTPProber) Probe(ctx context.Context) (time.Duration, error) {
+	method := p.Method
+	if method == "" {
+		method = http.MethodHead
+	}
+	// the request may be reported as written after the response arrived
+	var mu sync.Mutex
+	var wrote, firstByte time.Time
+	trace := &httptrace.ClientTrace{
+		WroteRequest: func(_ httptrace.WroteRequestInfo) {
+			mu.Lock()
+			wrote = time.Now()
+			mu.Unlock()
+		},
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), method, p.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	// drain the body so that the connection can be reused
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return 0, fmt.Errorf("%s %s: unexpected status %s", method, p.URL, resp.Status)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if wrote.IsZero() || firstByte.Before(wrote) {
+		// the server answered before the request was complete
+		return 0, fmt.Errorf("%s %s: no round trip measured", method, p.URL)
+	}
+	return firstByte.Sub(wrote), nil
+}
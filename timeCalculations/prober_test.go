@@ -0,0 +1,100 @@
+package timeCalculations
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTCPProber(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	addr := ln.Addr().String()
+
+	rtt, err := NewTCPProber(addr).Probe(context.Background())
+	if err != nil || rtt <= 0 {
+		t.Errorf("Probe = %v, %v, want a round trip", rtt, err)
+	}
+
+	ln.Close()
+	if _, err := NewTCPProber(addr).Probe(context.Background()); err == nil {
+		t.Error("Probe of a closed port succeeded")
+	}
+	if _, err := NewTCPProber("127.0.0.1").Probe(context.Background()); err == nil {
+		t.Error("Probe without a port succeeded")
+	}
+}
+
+func TestHTTPProber(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Method", r.Method)
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name, path, method string
+		err                string
+	}{
+		{"head", "/", "", ""},
+		{"get", "/", http.MethodGet, ""},
+		{"status", "/missing", "", "unexpected status 404"},
+	} {
+		p := NewHTTPProber(srv.URL + tc.path)
+		p.Method = tc.method
+		rtt, err := p.Probe(context.Background())
+		switch {
+		case tc.err == "" && (err != nil || rtt <= 0):
+			t.Errorf("%s: Probe = %v, %v, want a round trip", tc.name, rtt, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: Probe error %v, want %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestHTTPProberCancel(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := NewHTTPProber(srv.URL).Probe(ctx); err == nil {
+		t.Error("Probe ignored the context")
+	}
+}
+
+func TestICMPProber(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rtt, err := NewICMPProber("127.0.0.1", false).Probe(ctx)
+	if err != nil {
+		// unprivileged sockets depend on the platform and net.ipv4.ping_group_range
+		t.Skipf("no ICMP echo to localhost: %v", err)
+	}
+	if rtt <= 0 {
+		t.Errorf("Probe = %v, want a round trip", rtt)
+	}
+}
@@ -1,9 +1,10 @@
 package timeCalculations
 
 import (
+	"context"
+	"fmt"
 	"math"
 	"time"
-	// # ping "github.com/go-ping/ping"
 )
 
 // Statistics represents the jitter test results with corrected and uncorrected deviations
@@ -13,27 +14,38 @@ type JitterStatistics struct {
 
 	Host string
 	RTTS []time.Duration
-
-	UncorrectedSD    time.Duration
-	CorrectedSD      time.Duration
+	// Sent counts the probes, Lost the ones that failed
+	Sent, Lost int
+
+	UncorrectedSD time.Duration
+	CorrectedSD   time.Duration
+	// SquaredDeviation is the sum of the squared deviations of RTTS from
+	// their mean in nanoseconds squared, capped at the largest Duration; it
+	// is not a duration, see SquaredDeviationSeconds
 	SquaredDeviation time.Duration
+	// SquaredDeviationSeconds is the same sum in seconds squared; divided by
+	// len(RTTS) it is the variance
+	SquaredDeviationSeconds float64
 
 	RttRange time.Duration
-
-	// # PingStatistics *ping.Statistics
 }
 
 // Jitterer represents the configuration and actors to test jitter
 type Jitterer struct {
 	Host string
+	// Prober measures the round trips; if nil, RunContext pings Host over ICMP
+	Prober Prober
 	// blockSampleSize represents the number of measurements that will result in 1 jitter calculation
 	blockSampleSize int
-	// pingerStatistics represents results from ping
-	// # pingerStatistics *ping.Statistics
-	// pinger used to execute consecutive ping requests
-	// # pinger           *ping.Pinger
+	// pingerPrivileged selects raw instead of unprivileged ICMP sockets for the default prober
 	pingerPrivileged bool
-	pingerTimeout    time.Duration
+	// pingerTimeout bounds a single probe
+	pingerTimeout time.Duration
+	// pingerInterval is the time between the start of consecutive probes
+	pingerInterval time.Duration
+	// rtts of the successful probes of the last run
+	rtts []time.Duration
+	sent int
 	// startTime starting time of tests
 	startTime time.Time
 	// endTime ending time of tests
@@ -42,38 +54,64 @@ type Jitterer struct {
 
 // NewJitterer returns a new Jitterer for the host specified
 func NewJitterer(targetHost string) (*Jitterer, error) {
-	// # pngr, err := ping.NewPinger(targetHost)
-	// if err != nil {
-	// 	return nil, err
-	// }
-
+	if targetHost == "" {
+		return nil, fmt.Errorf("jitterer needs a host")
+	}
 	return &Jitterer{
 		Host:             targetHost,
 		blockSampleSize:  3,
 		pingerPrivileged: false,
 		pingerTimeout:    time.Second,
-		// # pinger:           pngr,
+		pingerInterval:   200 * time.Millisecond,
 	}, nil
 }
 
-// Run executes jitter test
+// Run executes jitter test, see RunContext; failed probes show as Lost in the Statistics
 func (j *Jitterer) Run() {
-	startTime := time.Now()
-
-	// j.pinger.SetPrivileged(j.pingerPrivileged)
-	// j.pinger.Count = j.blockSampleSize
-	// j.pinger.Timeout = j.pingerTimeout
-
-	// j.pinger.OnRecv = nil
-	// j.pinger.OnFinish = nil
-
-	// j.pinger.Run()
-	// endTime := time.Now()
+	j.RunContext(context.Background())
+}
 
-	// j.pingerStatistics = j.pinger.Statistics()
+// RunContext executes jitter test: it sends blockSampleSize probes, one every
+// interval, and keeps the round trips of those that succeed. It returns an
+// error if ctx is done or none of the probes succeeded.
+func (j *Jitterer) RunContext(ctx context.Context) error {
+	prober := j.Prober
+	if prober == nil {
+		prober = NewICMPProber(j.Host, j.pingerPrivileged)
+	}
 
-	j.startTime = startTime
-	// # j.endTime = endTime
+	j.startTime = time.Now()
+	j.rtts, j.sent = nil, 0
+	defer func() { j.endTime = time.Now() }()
+
+	ticker := time.NewTicker(j.pingerInterval)
+	defer ticker.Stop()
+	var lastErr error
+	for i := 0; i < j.blockSampleSize; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+		}
+		probeCtx, cancel := context.WithTimeout(ctx, j.pingerTimeout)
+		rtt, err := prober.Probe(probeCtx)
+		cancel()
+		j.sent++
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		j.rtts = append(j.rtts, rtt)
+	}
+	if len(j.rtts) == 0 && lastErr != nil {
+		return fmt.Errorf("all %d probes of %s failed: %v", j.sent, j.Host, lastErr)
+	}
+	return nil
 }
 
 // SetBlockSampleSize controls the number of test in the sample
@@ -91,28 +129,39 @@ func (j *Jitterer) SetPingerTimeout(timeout time.Duration) {
 	j.pingerTimeout = timeout
 }
 
+// SetPingerInterval time between consecutive tests
+func (j *Jitterer) SetPingerInterval(interval time.Duration) {
+	j.pingerInterval = interval
+}
+
 func (j *Jitterer) Statistics() *JitterStatistics {
 	return j.generateStatistics()
 }
 
 // generateStatistics calculates jitter
 func (j *Jitterer) generateStatistics() *JitterStatistics {
-	// usd := time.Duration(calculateUncorrectedDeviation(j.pingerStatistics.Rtts))
-	// csd := time.Duration(calculateCorrectedDeviation(j.pingerStatistics.Rtts))
-	// sd := time.Duration(calculateSquaredDeviation(j.pingerStatistics.Rtts))
-	// rng := calculateRange(j.pingerStatistics.Rtts)
-
-	return &JitterStatistics{
-		Host:  j.Host,
-		Start: j.startTime,
-		End:   j.endTime,
-		// PingStatistics:   j.pingerStatistics,
-		// RTTS:             j.pingerStatistics.Rtts,
-		// UncorrectedSD:    time.Duration(usd),
-		// CorrectedSD:      time.Duration(csd),
-		// SquaredDeviation: time.Duration(sd),
-		// RttRange:         rng,
+	st := &JitterStatistics{
+		Host:     j.Host,
+		Start:    j.startTime,
+		End:      j.endTime,
+		RTTS:     append([]time.Duration(nil), j.rtts...),
+		Sent:     j.sent,
+		Lost:     j.sent - len(j.rtts),
+		RttRange: calculateRange(j.rtts),
+	}
+	if len(j.rtts) > 0 {
+		st.UncorrectedSD = time.Duration(CalculateUncorrectedDeviation(j.rtts))
+		sd := CalculateSquaredDeviation(j.rtts)
+		st.SquaredDeviation = time.Duration(math.MaxInt64)
+		if sd < math.MaxInt64 {
+			st.SquaredDeviation = time.Duration(sd)
+		}
+		st.SquaredDeviationSeconds = sd / float64(time.Second) / float64(time.Second)
+	}
+	if len(j.rtts) > 1 {
+		st.CorrectedSD = time.Duration(CalculateCorrectedDeviation(j.rtts))
 	}
+	return st
 }
 
 // calculateRange finds the range of a slice of durations
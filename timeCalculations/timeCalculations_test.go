@@ -0,0 +1,147 @@
+package timeCalculations
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeProber returns the next of its round trips, or err for a zero one.
+type fakeProber struct {
+	rtts  []time.Duration
+	err   error
+	calls int
+}
+
+func (p *fakeProber) Probe(ctx context.Context) (time.Duration, error) {
+	rtt := p.rtts[p.calls%len(p.rtts)]
+	p.calls++
+	if rtt == 0 {
+		return 0, p.err
+	}
+	return rtt, nil
+}
+
+func newTestJitterer(t *testing.T, p Prober, n int) *Jitterer {
+	t.Helper()
+	j, err := NewJitterer("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Prober = p
+	j.SetBlockSampleSize(n)
+	j.SetPingerInterval(time.Millisecond)
+	return j
+}
+
+func TestJittererStatistics(t *testing.T) {
+	ms := time.Millisecond
+	lost := errors.New("lost")
+	for _, tc := range []struct {
+		name string
+		rtts []time.Duration
+		// want
+		sent, lost             int
+		uncorrected, corrected time.Duration
+		squaredSeconds         float64
+		rttRange               time.Duration
+	}{
+		{"steady", []time.Duration{10 * ms, 10 * ms, 10 * ms}, 3, 0, 0, 0, 0, 0},
+		{"spread", []time.Duration{10 * ms, 20 * ms, 30 * ms}, 3, 0, 8164965, 10 * ms, 200e-6, 20 * ms},
+		{"lost", []time.Duration{10 * ms, 0, 30 * ms}, 3, 1, 10 * ms, 14142135, 200e-6, 20 * ms},
+		{"single", []time.Duration{0, 0, 10 * ms}, 3, 2, 0, 0, 0, 0},
+	} {
+		j := newTestJitterer(t, &fakeProber{rtts: tc.rtts, err: lost}, len(tc.rtts))
+		if err := j.RunContext(context.Background()); err != nil {
+			t.Errorf("%s: RunContext: %v", tc.name, err)
+			continue
+		}
+		st := j.Statistics()
+		if st.Sent != tc.sent || st.Lost != tc.lost || len(st.RTTS) != tc.sent-tc.lost {
+			t.Errorf("%s: sent %d, lost %d, %d rtts, want %d, %d", tc.name, st.Sent, st.Lost, len(st.RTTS), tc.sent, tc.lost)
+		}
+		if st.UncorrectedSD != tc.uncorrected || st.CorrectedSD != tc.corrected || st.RttRange != tc.rttRange {
+			t.Errorf("%s: uncorrected %v, corrected %v, range %v, want %v, %v, %v", tc.name, st.UncorrectedSD, st.CorrectedSD, st.RttRange, tc.uncorrected, tc.corrected, tc.rttRange)
+		}
+		if math.Abs(st.SquaredDeviationSeconds-tc.squaredSeconds) > 1e-12 {
+			t.Errorf("%s: squared deviation %v s², want %v", tc.name, st.SquaredDeviationSeconds, tc.squaredSeconds)
+		}
+		if want := time.Duration(tc.squaredSeconds * 1e18); st.SquaredDeviation-want > 1 || want-st.SquaredDeviation > 1 {
+			t.Errorf("%s: SquaredDeviation %d, want %d", tc.name, st.SquaredDeviation, want)
+		}
+		if st.Start.IsZero() || st.End.Before(st.Start) {
+			t.Errorf("%s: start %v, end %v", tc.name, st.Start, st.End)
+		}
+	}
+}
+
+func TestSquaredDeviationCapped(t *testing.T) {
+	// a spread of seconds overflows nanoseconds squared
+	j := newTestJitterer(t, &fakeProber{rtts: []time.Duration{time.Second, 10 * time.Second}}, 2)
+	if err := j.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	st := j.Statistics()
+	if st.SquaredDeviation != math.MaxInt64 {
+		t.Errorf("SquaredDeviation = %d, want it capped", st.SquaredDeviation)
+	}
+	if st.SquaredDeviationSeconds != 40.5 {
+		t.Errorf("SquaredDeviationSeconds = %v, want 40.5", st.SquaredDeviationSeconds)
+	}
+}
+
+func TestJittererAllLost(t *testing.T) {
+	j := newTestJitterer(t, &fakeProber{rtts: []time.Duration{0}, err: errors.New("no reply")}, 3)
+	err := j.RunContext(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "no reply") {
+		t.Fatalf("RunContext = %v, want the probe error", err)
+	}
+	if st := j.Statistics(); st.Sent != 3 || st.Lost != 3 || st.CorrectedSD != 0 {
+		t.Errorf("sent %d, lost %d, corrected %v", st.Sent, st.Lost, st.CorrectedSD)
+	}
+
+	// Run keeps its old signature and reports through the statistics
+	j.Run()
+	if st := j.Statistics(); st.Lost != 3 {
+		t.Errorf("Run: lost %d, want 3", st.Lost)
+	}
+}
+
+// blockingProber waits for its context.
+type blockingProber struct{}
+
+func (blockingProber) Probe(ctx context.Context) (time.Duration, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestJittererCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := newTestJitterer(t, blockingProber{}, 3)
+	j.SetPingerTimeout(time.Hour)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := j.RunContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("RunContext = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestJittererProbeTimeout(t *testing.T) {
+	j := newTestJitterer(t, blockingProber{}, 2)
+	j.SetPingerTimeout(5 * time.Millisecond)
+	err := j.RunContext(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "all 2 probes") {
+		t.Errorf("RunContext = %v, want all probes failed", err)
+	}
+	if st := j.Statistics(); st.Lost != 2 {
+		t.Errorf("lost %d, want 2", st.Lost)
+	}
+}
+
+func TestNewJittererNeedsHost(t *testing.T) {
+	if _, err := NewJitterer(""); err == nil {
+		t.Error("NewJitterer accepted an empty host")
+	}
+}